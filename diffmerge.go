@@ -74,33 +74,173 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
 
 	"github.com/jamessynge/diffmerge/dm"
 )
 
-var (
-	pDiff3Flag = flag.Bool(
-		"diff3", false, "Find difference between 3 files.")
+// The flags of the subcommands, other than those of DifferencerConfig and
+// MergeConfig, which are shared by all of them. Each subcommand registers
+// only those flags that apply to it.
+type cmdOptions struct {
+	statusOnly bool
 
-	pStatusOnlyFlag = flag.Bool(
-		"brief", false, "Report (via exit code) whether there were differences "+
-			" (for diff) or conflicts (for diff3/merge) found.")
+	// Output format of diffs.
+	format         string
+	sideBySide     bool
+	unified        bool
+	unifiedContext int
+	context        bool
+	contextLines   int
+	edScript       bool
+	rcs            bool
+	jsonLines      bool
+	intraLine      bool
+	color          string
 
-	pSideBySideFlag = flag.Bool(
-		"side-by-side", true, "For diff of two files, display results side-by-side.")
-)
+	recursive      bool
+	diff3          bool
+	gitMergeDriver bool
+	printMerge     bool
+	applyPatch     string
+	importPatch    string
+	configFile     string
+
+	labels labelsFlag
+}
+
+func (o *cmdOptions) addBriefFlag(f *flag.FlagSet) {
+	f.BoolVar(
+		&o.statusOnly, "brief", false, "Report (via exit code) whether there were "+
+			"differences (for diff) or conflicts (for diff3/merge) found.")
+}
+
+func (o *cmdOptions) addFormatFlag(f *flag.FlagSet, usage string) {
+	f.StringVar(&o.format, "format", "text", usage)
+}
+
+// Registers the flags selecting how the diff of two files is output.
+func (o *cmdOptions) addDiff2OutputFlags(f *flag.FlagSet) {
+	f.BoolVar(
+		&o.sideBySide, "side-by-side", true, "For diff of two files, display "+
+			"results side-by-side.")
+
+	f.BoolVar(
+		&o.unified, "u", false, "For diff of two files, output a unified diff "+
+			"(as for diff -u) with 3 lines of context.")
+
+	f.IntVar(
+		&o.unifiedContext, "U", -1, "For diff of two files, output a unified "+
+			"diff with this many lines of context.")
+
+	f.BoolVar(
+		&o.context, "c", false, "For diff of two files, output a context diff "+
+			"(as for diff -c) with 3 lines of context.")
+
+	f.IntVar(
+		&o.contextLines, "C", -1, "For diff of two files, output a context diff "+
+			"with this many lines of context.")
+
+	f.BoolVar(
+		&o.edScript, "e", false, "For diff of two files, output an ed script "+
+			"(as for diff -e).")
+
+	f.BoolVar(
+		&o.rcs, "n", false, "For diff of two files, output an RCS format diff "+
+			"(as for diff -n).")
+
+	f.BoolVar(
+		&o.jsonLines, "json-lines", true, "With -format=json, include the lines "+
+			"of the files.")
+
+	f.BoolVar(
+		&o.intraLine, "intra-line", false, "For diff of two files, compare "+
+			"changed lines token by token, and mark the changed characters.")
+
+	f.StringVar(
+		&o.color, "color", "auto", "For side-by-side and interleaved diffs, "+
+			"whether to color the output by kind of change: \"auto\" (if stdout "+
+			"is a terminal, unless overridden by $"+dm.ColorEnvVar+"=always|never "+
+			"or $NO_COLOR), \"always\" or \"never\".")
+}
+
+func (o *cmdOptions) addRecursiveFlag(f *flag.FlagSet) {
+	f.BoolVar(
+		&o.recursive, "r", false, "Compare two directory trees, pairing files "+
+			"by their relative paths, and output the diff of each pair of text "+
+			"files which differ, in the format selected by the other flags. "+
+			"Renamed files are paired by their contents, and blocks of lines "+
+			"moved between files are reported if -detect-block-moves is set.")
+}
+
+func (o *cmdOptions) addImportFlag(f *flag.FlagSet) {
+	f.StringVar(
+		&o.importPatch, "import", "", "Display the unified diff in this file "+
+			"(e.g. produced by another tool) as if diffmerge had produced it, "+
+			"given the original file as the file argument. Deletions and "+
+			"insertions of the same lines are shown as moves if "+
+			"-detect-block-moves is set.")
+}
+
+func (o *cmdOptions) addGitMergeDriverFlag(f *flag.FlagSet) {
+	f.BoolVar(
+		&o.gitMergeDriver, "git-merge-driver", false, "Act as a git merge "+
+			"driver, with the arguments %O %A %B %L %P (base, ours, theirs, "+
+			"conflict marker size and path): the merge result is written to "+
+			"ours, and the exit status is non-zero if there are conflicts. See "+
+			"README.md.")
+}
 
-// TODO Add support for merge(1)'s -L (label) flag, which can appear up to
-// 3 times in the command line args. See https://play.golang.org/p/Ig5sm7jA14
-// for an example of how to do this.
+// Supports merge(1)'s -L (label) flag, which can appear up to 3 times in the
+// command line args, and which provides the names to be used in place of the
+// file names in output (e.g. in conflict markers). The first label is for
+// the first file, etc.
+type labelsFlag []string
+
+func (p *labelsFlag) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *labelsFlag) Set(value string) error {
+	if len(*p) >= 3 {
+		return fmt.Errorf("at most 3 labels may be specified")
+	}
+	*p = append(*p, value)
+	return nil
+}
+
+func (o *cmdOptions) addLabelsFlag(f *flag.FlagSet) {
+	f.Var(&o.labels, "L", "Label to use in place of the corresponding file "+
+		"name in output; may be repeated up to 3 times (for yours, base and theirs).")
+}
+
+func (o *cmdOptions) addConfigFlag(f *flag.FlagSet) {
+	f.StringVar(
+		&o.configFile, "config", "", "Read the settings for aligning files from "+
+			"this config file, rather than from the user's and the project's "+
+			"config files (see README.md). Flags override the settings of config "+
+			"files.")
+}
+
+// Fails if the -format flag isn't one of the supported formats.
+func (o *cmdOptions) checkFormat(formats ...string) {
+	for _, format := range formats {
+		if o.format == format {
+			return
+		}
+	}
+	FailWithMessage(true, "Unknown output format: %q", o.format)
+}
 
 type CmdStatus int
 
@@ -131,7 +271,17 @@ type cmdInputs struct {
 	// Output used for merge with 3 inputs and one output.
 	outputFileName string
 
-	diffConfig dm.DifferencerConfig
+	opts        cmdOptions
+	diffConfig  dm.DifferencerConfig
+	mergeConfig dm.MergeConfig
+
+	// The config files, and the DifferencerConfig flags set on the command
+	// line (as the last of them), from which diffConfig is derived for the
+	// files being compared.
+	configs dm.ConfigFiles
+
+	// Should the side-by-side or interleaved output be colored?
+	color bool
 }
 
 func (p *cmdInputs) AddInputFile(fileName string) {
@@ -146,6 +296,9 @@ func (p *cmdInputs) AddInputFile(fileName string) {
 		FailWithMessage(false, "Failed to read file %s: %s", fileName, err)
 		os.Exit(int(AnError) & 0xff)
 	}
+	if len(p.files) == 0 {
+		p.diffConfig = p.configFor(fileName)
+	}
 	p.fileNames = append(p.fileNames, fileName)
 	p.files = append(p.files, file)
 	if p.perm == 0 && fileName != "-" {
@@ -156,11 +309,21 @@ func (p *cmdInputs) AddInputFile(fileName string) {
 	}
 }
 
+func (p *cmdInputs) ApplyLabels(labels []string) {
+	if len(labels) > len(p.files) {
+		FailWithMessage(true, "Too many labels (%d) for %d input files",
+			len(labels), len(p.files))
+	}
+	for n, label := range labels {
+		p.files[n].Label = label
+	}
+}
+
 func (p *cmdInputs) diff2Files(
 	fromFile, toFile *dm.File) (pairs dm.BlockPairs, status CmdStatus) {
 	pairs = dm.PerformDiff2(fromFile, toFile, p.diffConfig)
 	glog.Flush()
-	if len(pairs) == 1 && pairs[0].IsMatch {
+	if len(pairs) == 0 || (len(pairs) == 1 && pairs[0].IsMatch) {
 		status = NoDifferences
 	} else {
 		status = SomeDifferences
@@ -181,13 +344,17 @@ func (p *cmdInputs) diff3Files() *diff3State {
 }
 
 func (p *cmdInputs) outputFile(f *dm.File) {
+	p.outputBody(f.Body)
+}
+
+func (p *cmdInputs) outputBody(body []byte) {
 	if p.outputFileName != "" {
-		err := ioutil.WriteFile(p.outputFileName, f.Body, p.perm)
+		err := ioutil.WriteFile(p.outputFileName, body, p.perm)
 		if err != nil {
 			FailWithMessage(false, "Failed writing to %s; error: %s", p.outputFileName, err)
 		}
 	} else {
-		r := bytes.NewReader(f.Body)
+		r := bytes.NewReader(body)
 		_, err := io.Copy(os.Stdout, r)
 		if err != nil {
 			FailWithMessage(false, "Failed writing to stdout; error: %s", err)
@@ -198,25 +365,192 @@ func (p *cmdInputs) outputFile(f *dm.File) {
 func (p *cmdInputs) PerformDiff2() CmdStatus {
 	fromFile, toFile := p.files[0], p.files[1]
 	pairs, status := p.diff2Files(fromFile, toFile)
-	if *pSideBySideFlag {
-		dm.FormatSideBySide(
-			fromFile, toFile, pairs, false,
-			os.Stdout, dm.DefaultSideBySideConfig)
+	p.outputDiff2(fromFile, toFile, pairs)
+	return status
+}
+
+// Writes the diff to stdout in the format selected by the flags.
+func (p *cmdInputs) outputDiff2(fromFile, toFile *dm.File, pairs dm.BlockPairs) {
+	var err error
+	if p.opts.format == "json" {
+		err = dm.FormatDiffJSON(fromFile, toFile, pairs, p.opts.jsonLines, os.Stdout)
+	} else if p.opts.format == "html" {
+		err = dm.FormatHTMLSideBySide(fromFile, toFile, pairs, os.Stdout,
+			dm.DefaultSideBySideConfig)
+	} else if p.opts.unified || p.opts.unifiedContext >= 0 {
+		err = dm.FormatUnifiedDiff(fromFile, toFile, pairs,
+			contextLinesFlagValue(p.opts.unifiedContext), os.Stdout)
+	} else if p.opts.context || p.opts.contextLines >= 0 {
+		err = dm.FormatContextDiff(fromFile, toFile, pairs,
+			contextLinesFlagValue(p.opts.contextLines), os.Stdout)
+	} else if p.opts.edScript {
+		err = dm.FormatEdScript(fromFile, toFile, pairs, os.Stdout)
+	} else if p.opts.rcs {
+		err = dm.FormatRCSDiff(fromFile, toFile, pairs, os.Stdout)
 	} else {
-		dm.FormatInterleaved(pairs, false, fromFile, toFile, os.Stdout, true)
+		var intraLineDiffs *dm.IntraLineDiffs
+		if p.opts.intraLine {
+			intraLineDiffs = dm.PerformIntraLineDiff(fromFile, toFile, pairs)
+		}
+		if p.opts.sideBySide {
+			cfg := dm.DefaultSideBySideConfig
+			cfg.Color = p.color
+			dm.FormatSideBySideWithIntraLineDiffs(
+				fromFile, toFile, pairs, false, intraLineDiffs, os.Stdout, cfg)
+		} else if p.color {
+			err = dm.FormatColoredInterleaved(
+				pairs, false, fromFile, toFile, intraLineDiffs, os.Stdout, true)
+		} else {
+			err = dm.FormatInterleavedWithIntraLineDiffs(
+				pairs, false, fromFile, toFile, intraLineDiffs, os.Stdout, true)
+		}
+	}
+	if err != nil {
+		FailWithMessage(false, "Failed writing to stdout; error: %s", err)
+	}
+}
+
+// Merges as a git merge driver, given the arguments %O %A %B %L and
+// (optionally) %P: the files containing the base, ours and theirs versions,
+// the size of conflict markers, and the path of the file being merged. The
+// result is written to the ours file (even if there are conflicts, which git
+// expects to find marked in the file).
+func (p *cmdInputs) PerformGitMergeDriver(args []string) CmdStatus {
+	if p.opts.statusOnly {
+		// git takes the ours file as the result, so it must be written.
+		FailWithMessage(true, "-brief can't be used with -git-merge-driver")
+	}
+	base, ours, theirs := args[0], args[1], args[2]
+	markerSize, err := strconv.Atoi(args[3])
+	if err != nil || markerSize <= 0 {
+		FailWithMessage(true, "Invalid conflict marker size: %q", args[3])
+	}
+	p.mergeConfig.ConflictMarkerSize = markerSize
+	path := ours
+	if len(args) > 4 {
+		path = args[4]
+	}
+	p.AddInputFile(ours)
+	p.AddInputFile(base)
+	p.AddInputFile(theirs)
+	p.files[0].Label = "ours:" + path
+	p.files[1].Label = "base:" + path
+	p.files[2].Label = "theirs:" + path
+	p.ApplyLabels(p.opts.labels)
+	p.diffConfig = p.configFor(path)
+	p.outputFileName = ours
+	return p.PerformMerge()
+}
+
+// Returns the line with which "diff -r" reports that the file at path (slash
+// separated, relative to root) is only in the tree at root: i.e. the file, or
+// the outermost of its directories which isn't in the tree at otherRoot, as
+// in "Only in root/dir: name". Returns "" if that directory has already been
+// reported (as recorded in reported).
+func onlyInMessage(root, otherRoot, path string, reported map[string]bool) string {
+	parts := strings.Split(path, "/")
+	n := 1
+	for ; n < len(parts); n++ {
+		dir := filepath.Join(otherRoot, filepath.FromSlash(strings.Join(parts[:n], "/")))
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			break
+		}
+	}
+	parent := filepath.Join(append([]string{root}, parts[:n-1]...)...)
+	name := parts[n-1]
+	key := filepath.Join(parent, name)
+	if reported[key] {
+		return ""
+	}
+	reported[key] = true
+	return fmt.Sprintf("Only in %s: %s", parent, name)
+}
+
+// Compares the two directory trees, writing the differences in the format
+// selected by the flags. Files only in one tree, and binary files which
+// differ, are reported as by "diff -r".
+func (p *cmdInputs) PerformDirectoryDiff(aDir, bDir string) CmdStatus {
+	dirDiff, err := dm.CompareDirectoriesUsing(aDir, bDir, p.configFor)
+	if err != nil {
+		FailWithMessage(false, "Failed to compare directories: %s", err)
+	}
+	status := NoDifferences
+	if dirDiff.HasDifferences() {
+		status = SomeDifferences
+	}
+	if p.opts.statusOnly {
+		return status
+	}
+	if p.opts.format == "json" {
+		err = dm.FormatDirDiffJSON(dirDiff, p.opts.jsonLines, os.Stdout)
+	} else if p.opts.format == "html" {
+		err = dm.FormatHTMLDirDiff(dirDiff, os.Stdout, dm.DefaultSideBySideConfig)
+	} else {
+		reported := make(map[string]bool)
+		for _, entry := range dirDiff.Entries {
+			switch entry.Status {
+			case dm.FilesDiffer, dm.FileRenamed:
+				if entry.Status == dm.FileRenamed {
+					fmt.Printf("Renamed %s to %s\n", entry.APath, entry.BPath)
+				}
+				if !bytes.Equal(entry.AFile.Body, entry.BFile.Body) {
+					fmt.Printf("diffmerge -r %s %s\n", entry.APath, entry.BPath)
+					p.outputDiff2(entry.AFile, entry.BFile, entry.Pairs)
+				}
+			case dm.BinaryFilesDiffer:
+				fmt.Printf("Binary files %s and %s differ\n", entry.APath, entry.BPath)
+			case dm.OnlyInA:
+				if msg := onlyInMessage(aDir, bDir, entry.Path, reported); msg != "" {
+					fmt.Println(msg)
+				}
+			case dm.OnlyInB:
+				if msg := onlyInMessage(bDir, aDir, entry.Path, reported); msg != "" {
+					fmt.Println(msg)
+				}
+			}
+			for _, move := range dirDiff.MovesFrom(entry) {
+				fmt.Printf("%s: %s\n", entry.APath, move.MovedToString())
+			}
+			for _, move := range dirDiff.MovesTo(entry) {
+				fmt.Printf("%s: %s\n", entry.BPath, move.MovedFromString())
+			}
+		}
+	}
+	if err != nil {
+		FailWithMessage(false, "Failed writing to stdout; error: %s", err)
 	}
 	return status
 }
 
+// Returns the number of context lines specified by -U or -C, or the default
+// of 3 if the flag wasn't specified.
+func contextLinesFlagValue(value int) int {
+	if value < 0 {
+		return 3
+	}
+	return value
+}
+
 func (p *cmdInputs) PerformDiff3() CmdStatus {
 	d3s := p.diff3Files()
-	outputFile := d3s.noConflictPossibleOutputFile()
-	if outputFile != nil {
-		p.outputFile(outputFile)
-		return ConflictFree
-	}
 	d3s.performDiff3()
-	return AnError
+	if !p.opts.statusOnly {
+		var err error
+		if p.opts.format == "html" {
+			err = dm.FormatHTMLDiff3(d3s.yours, d3s.base, d3s.theirs,
+				d3s.diff3Triples, os.Stdout, dm.DefaultSideBySideConfig)
+		} else {
+			err = dm.FormatDiff3(
+				d3s.yours, d3s.base, d3s.theirs, d3s.diff3Triples, os.Stdout)
+		}
+		if err != nil {
+			FailWithMessage(false, "Failed writing to stdout; error: %s", err)
+		}
+	}
+	if d3s.conflictsExist {
+		return SomeConflicts
+	}
+	return ConflictFree
 }
 
 func (p *cmdInputs) PerformMerge() CmdStatus {
@@ -226,27 +560,29 @@ func (p *cmdInputs) PerformMerge() CmdStatus {
 		p.outputFile(outputFile)
 		return ConflictFree
 	}
-	yours, base, theirs := p.files[0], p.files[1], p.files[2]
-	b2yPairs, b2yStatus := p.diff2Files(base, yours)
-	b2tPairs, b2tStatus := p.diff2Files(base, theirs)
 
-	// len(.) == 1 expression included temporarily to supporess complaints about
-	// unused vars.  TODO Remove.
-	if b2yStatus == NoDifferences && len(b2yPairs) == 1 {
-		// No changes in your file, so there can be no conflicts; output their file.
-		p.outputFile(theirs)
-		return ConflictFree
-	} else if b2tStatus == NoDifferences && len(b2tPairs) == 1 {
-		// No changes in their file, so there can be no conflicts; output your file.
-		p.outputFile(yours)
-		return ConflictFree
+	// Both yours and theirs have changed, so find the changes, and merge
+	// those that don't conflict.
+	var result *dm.MergeResult
+	if p.mergeConfig.MergeMoves {
+		result = dm.PerformMoveAwareMerge(d3s.yours, d3s.base, d3s.theirs,
+			d3s.b2yPairs, d3s.b2tPairs, p.diffConfig, p.mergeConfig)
+	} else {
+		d3s.performDiff3()
+		result = dm.PerformMerge(
+			d3s.yours, d3s.base, d3s.theirs, d3s.diff3Triples, p.mergeConfig)
 	}
-
-	// Determine if there are possible conflicts. If so, then maybe do a diff of
-	// yours vs. theirs, which may help eliminate the diff.
-	// Start by sorting on the same index, base.
-
-	return AnError // TODO Replace with correct value.
+	if !p.opts.statusOnly {
+		p.outputBody(result.Body)
+		if len(result.Resolutions) > 0 || len(result.RenameRewrites) > 0 {
+			result.FormatSummary(os.Stderr)
+		}
+	}
+	if result.NumConflicts > 0 {
+		glog.Infof("Merge produced %d conflicts", result.NumConflicts)
+		return SomeConflicts
+	}
+	return ConflictFree
 }
 
 type diff3State struct {
@@ -270,25 +606,458 @@ func (p *diff3State) noConflictPossibleOutputFile() *dm.File {
 	return nil
 }
 
+// Applies the patch (for the file named by the patch, or the only file in
+// the patch) to the first input file, reporting the result of each hunk.
+func (p *cmdInputs) PerformApply(patchFileName string) CmdStatus {
+	patchFile, err := os.Open(patchFileName)
+	if err != nil {
+		FailWithMessage(false, "Failed to read patch %s: %s", patchFileName, err)
+	}
+	defer patchFile.Close()
+	patches, err := dm.ParseUnifiedDiff(patchFile)
+	if err != nil {
+		FailWithMessage(false, "Failed to parse patch %s: %s", patchFileName, err)
+	}
+	patch := selectFilePatch(patches, p.fileNames[0])
+	if patch == nil {
+		FailWithMessage(false, "Patch %s has no changes for %s", patchFileName, p.fileNames[0])
+	}
+	result := dm.ApplyPatch(p.files[0], patch, p.diffConfig)
+	if !p.opts.statusOnly {
+		p.outputBody(result.Output)
+		result.FormatSummary(os.Stderr)
+	}
+	if n := result.NumFailed(); n > 0 {
+		glog.Infof("%d of %d hunks failed", n, len(result.Hunks))
+		return SomeConflicts
+	}
+	return ConflictFree
+}
+
+// Displays the changes made by the patch (for the file named by the patch, or
+// the only file in the patch) to the first input file.
+func (p *cmdInputs) PerformImport(patchFileName string) CmdStatus {
+	patchFile, err := os.Open(patchFileName)
+	if err != nil {
+		FailWithMessage(false, "Failed to read patch %s: %s", patchFileName, err)
+	}
+	defer patchFile.Close()
+	patches, err := dm.ParseUnifiedDiff(patchFile)
+	if err != nil {
+		FailWithMessage(false, "Failed to parse patch %s: %s", patchFileName, err)
+	}
+	patch := selectFilePatch(patches, p.fileNames[0])
+	if patch == nil {
+		FailWithMessage(false, "Patch %s has no changes for %s", patchFileName, p.fileNames[0])
+	}
+	fromFile, toFile, pairs, err := dm.ImportUnifiedDiff(p.files[0], patch, p.diffConfig)
+	if err != nil {
+		FailWithMessage(false, "Failed to import patch %s: %s", patchFileName, err)
+	}
+	if len(pairs) == 0 || (len(pairs) == 1 && pairs[0].IsMatch) {
+		return NoDifferences
+	}
+	if !p.opts.statusOnly {
+		p.outputDiff2(fromFile, toFile, pairs)
+	}
+	return SomeDifferences
+}
+
+// Returns the patch whose old (or new) name matches fileName, ignoring the
+// "a/" and "b/" prefixes that git adds, or the only patch if there is one.
+func selectFilePatch(patches []*dm.FilePatch, fileName string) *dm.FilePatch {
+	if len(patches) == 1 {
+		return patches[0]
+	}
+	clean := func(name string) string {
+		if len(name) > 2 && (name[:2] == "a/" || name[:2] == "b/") {
+			name = name[2:]
+		}
+		return filepath.Clean(name)
+	}
+	fileName = filepath.Clean(fileName)
+	for _, patch := range patches {
+		if clean(patch.OldName) == fileName || clean(patch.NewName) == fileName {
+			return patch
+		}
+	}
+	return nil
+}
+
 func (p *diff3State) performDiff3() {
 	p.diff3Triples, p.conflictsExist = dm.PerformDiff3(
 		p.yours, p.base, p.theirs, p.b2yPairs, p.b2tPairs, p.ci.diffConfig)
 }
 
-func main() {
-	diffConfig := &dm.DifferencerConfig{}
-	diffConfig.CreateFlags(flag.CommandLine)
-	flag.Parse() // Scan the arguments list
+// Reports the number of lines unchanged, inserted, deleted, moved, etc.
+// between the two input files.
+func (p *cmdInputs) PerformStats() CmdStatus {
+	fromFile, toFile := p.files[0], p.files[1]
+	pairs, _ := p.diff2Files(fromFile, toFile)
+	stats := dm.ComputeDiffStats(fromFile, toFile, pairs)
+	if !p.opts.statusOnly {
+		var err error
+		if p.opts.format == "json" {
+			var encoded []byte
+			if encoded, err = json.Marshal(stats); err == nil {
+				_, err = fmt.Printf("%s\n", encoded)
+			}
+		} else {
+			_, err = fmt.Printf("%s => %s: %s\n",
+				fromFile.DisplayName(), toFile.DisplayName(), stats)
+		}
+		if err != nil {
+			FailWithMessage(false, "Failed writing to stdout; error: %s", err)
+		}
+	}
+	if stats.HasDifferences() {
+		return SomeDifferences
+	}
+	return NoDifferences
+}
+
+// A subcommand, such as "diffmerge merge", each of which has its own flags
+// (in addition to those of DifferencerConfig, which all share) and usage.
+type subcommand struct {
+	name string
+
+	// The arguments (after the flags), and a description, for the usage.
+	args, description string
+
+	// If true, the subcommand is also run when the binary has the same name
+	// (e.g. via a symlink named diff3), in which case it should behave like
+	// the standard tool of that name.
+	isTool bool
+
+	// Registers the flags of the subcommand. asTool is true if the binary has
+	// the name of the subcommand.
+	addFlags func(f *flag.FlagSet, ci *cmdInputs, asTool bool)
+
+	// Checks the number of arguments, and runs the subcommand.
+	run func(ci *cmdInputs, args []string, asTool bool) CmdStatus
+}
+
+var subcommands = []*subcommand{
+	{
+		name: "diff",
+		args: "<from-file> <to-file>",
+		description: "Compare two files (or with -r, two directory trees), " +
+			"outputting the differences in the format selected by the flags.",
+		// Not a tool, as the default output isn't that of diff(1).
+		isTool: false,
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {
+			ci.opts.addBriefFlag(f)
+			ci.opts.addFormatFlag(f, "The output format: \"text\" (as selected by "+
+				"the other flags), \"json\" (the matched and unmatched blocks, with "+
+				"a versioned schema), or \"html\" (a self-contained report).")
+			ci.opts.addDiff2OutputFlags(f)
+			ci.opts.addRecursiveFlag(f)
+			ci.opts.addImportFlag(f)
+			ci.opts.addLabelsFlag(f)
+		},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			ci.opts.checkFormat("text", "json", "html")
+			if ci.opts.importPatch != "" {
+				if len(args) != 1 {
+					FailWithMessage(true, "-import requires the original file as the only file argument")
+				}
+				ci.AddInputFile(args[0])
+				ci.ApplyLabels(ci.opts.labels)
+				return ci.PerformImport(ci.opts.importPatch)
+			}
+			if len(args) != 2 {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			if ci.opts.recursive {
+				return ci.PerformDirectoryDiff(args[0], args[1])
+			}
+			ci.AddInputFile(args[0])
+			ci.AddInputFile(args[1])
+			ci.ApplyLabels(ci.opts.labels)
+			return ci.PerformDiff2()
+		},
+	},
+	{
+		name: "diff3",
+		args: "<yours> <base> <theirs>",
+		description: "Compare three files, outputting the blocks of lines " +
+			"which differ (as for diff3).",
+		isTool: true,
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {
+			ci.opts.addBriefFlag(f)
+			ci.opts.addFormatFlag(f, "The output format: \"text\" (as for diff3), "+
+				"or \"html\" (a self-contained report).")
+			ci.opts.addLabelsFlag(f)
+		},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			ci.opts.checkFormat("text", "html")
+			if len(args) != 3 {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			for _, arg := range args {
+				ci.AddInputFile(arg)
+			}
+			ci.ApplyLabels(ci.opts.labels)
+			return ci.PerformDiff3()
+		},
+	},
+	{
+		name: "merge",
+		args: "<yours> <base> <theirs> [<output>]",
+		description: "Merge the changes from base to theirs into yours, " +
+			"writing the result to output, or to stdout. When run as merge (e.g. " +
+			"via a symlink), the result is written to yours unless -p is set, " +
+			"as for merge(1).",
+		isTool: true,
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {
+			ci.opts.addBriefFlag(f)
+			ci.opts.addLabelsFlag(f)
+			ci.opts.addGitMergeDriverFlag(f)
+			ci.mergeConfig.CreateFlags(f)
+			if asTool {
+				f.BoolVar(&ci.opts.printMerge, "p", false,
+					"Write the result to stdout rather than to yours.")
+			}
+		},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			if ci.opts.gitMergeDriver {
+				if !(4 <= len(args) && len(args) <= 5) {
+					FailWithMessage(true, "-git-merge-driver requires the arguments %%O %%A %%B %%L [%%P]")
+				}
+				return ci.PerformGitMergeDriver(args)
+			}
+			if !(3 <= len(args) && len(args) <= 4) {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			for _, arg := range args[:3] {
+				ci.AddInputFile(arg)
+			}
+			if len(args) > 3 {
+				ci.outputFileName = args[3]
+			} else if asTool && !ci.opts.printMerge {
+				ci.outputFileName = args[0]
+			}
+			ci.ApplyLabels(ci.opts.labels)
+			return ci.PerformMerge()
+		},
+	},
+	{
+		name: "apply",
+		args: "<patch> <file> [<output>]",
+		description: "Apply the unified diff in patch to file, writing the " +
+			"result to output, or to stdout. Hunks are placed by aligning their " +
+			"lines with the file, so they can be applied even if the code has " +
+			"moved. The exit status is non-zero if any hunks fail.",
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {
+			ci.opts.addBriefFlag(f)
+		},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			if !(2 <= len(args) && len(args) <= 3) {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			ci.AddInputFile(args[1])
+			if len(args) > 2 {
+				ci.outputFileName = args[2]
+			}
+			return ci.PerformApply(args[0])
+		},
+	},
+	{
+		name: "stats",
+		args: "<from-file> <to-file>",
+		description: "Summarize the differences between two files: the number " +
+			"of lines unchanged, inserted, deleted, moved, and changed only in " +
+			"their white space.",
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {
+			ci.opts.addBriefFlag(f)
+			ci.opts.addFormatFlag(f, "The output format: \"text\" or \"json\".")
+		},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			ci.opts.checkFormat("text", "json")
+			if len(args) != 2 {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			ci.AddInputFile(args[0])
+			ci.AddInputFile(args[1])
+			return ci.PerformStats()
+		},
+	},
+	{
+		name: "config",
+		args: "[<file>]",
+		description: "Print the settings for aligning the file (or any file), " +
+			"from the config files and the flags, in the format of a config file.",
+		addFlags: func(f *flag.FlagSet, ci *cmdInputs, asTool bool) {},
+		run: func(ci *cmdInputs, args []string, asTool bool) CmdStatus {
+			if len(args) > 1 {
+				FailWithMessage(true, "Wrong number of file arguments")
+			}
+			fileName := ""
+			if len(args) > 0 {
+				fileName = args[0]
+			}
+			for _, config := range ci.configs {
+				fmt.Printf("# From %s\n", config.Path)
+			}
+			if err := dm.FormatDifferencerConfig(ci.configFor(fileName), os.Stdout); err != nil {
+				FailWithMessage(false, "Failed writing to stdout; error: %s", err)
+			}
+			return ConflictFree
+		},
+	},
+}
+
+// Reads the config files (those named by -config, else those found by
+// dm.FindConfigFiles), and records the DifferencerConfig flags that were set
+// in f, which override the settings of the files.
+func (p *cmdInputs) loadConfigs(f *flag.FlagSet) {
+	paths := dm.FindConfigFiles()
+	if p.opts.configFile != "" {
+		paths = []string{p.opts.configFile}
+	}
+	configs, err := dm.ReadConfigFiles(paths...)
+	if err != nil {
+		FailWithMessage(false, "Failed to read config file: %s", err)
+	}
+	var scratch dm.DifferencerConfig
+	diffFlags := flag.NewFlagSet("scratch", flag.ContinueOnError)
+	scratch.CreateFlags(diffFlags)
+	cmdLine := &dm.ConfigSection{}
+	f.Visit(func(fl *flag.Flag) {
+		if diffFlags.Lookup(fl.Name) != nil {
+			cmdLine.Settings = append(cmdLine.Settings,
+				dm.ConfigSetting{Name: fl.Name, Value: fl.Value.String()})
+		}
+	})
+	p.configs = configs
+	if len(cmdLine.Settings) > 0 {
+		p.configs = append(p.configs, &dm.ConfigFile{
+			Path:     "command line",
+			Sections: []*dm.ConfigSection{cmdLine},
+		})
+	}
+	p.diffConfig = p.configFor("")
+}
+
+// Returns the DifferencerConfig for comparing the file.
+func (p *cmdInputs) configFor(fileName string) dm.DifferencerConfig {
+	config, err := p.configs.DifferencerConfigFor(fileName)
+	if err != nil {
+		FailWithMessage(false, "Invalid config: %s", err)
+	}
+	glog.V(1).Infof("DifferencerConfig for %q: %+v", fileName, config)
+	return config
+}
+
+func findSubcommand(name string) *subcommand {
+	for _, sc := range subcommands {
+		if sc.name == name {
+			return sc
+		}
+	}
+	return nil
+}
 
-	cmd := filepath.Base(os.Args[0])
-	glog.V(1).Infoln("cmd =", cmd)
+// Sets the fields of ci that are derived from the flags, once the flags in f
+// have been parsed.
+func (p *cmdInputs) finishFlags(f *flag.FlagSet) {
+	p.loadConfigs(f)
+	if p.opts.color != "" {
+		color, err := dm.ShouldUseColor(p.opts.color, os.Stdout)
+		if err != nil {
+			FailWithMessage(true, "%s", err)
+		}
+		p.color = color
+	}
+}
+
+// Parses the flags of the subcommand from args, and runs it. cmdName is the
+// name by which it was invoked (e.g. "diffmerge merge", or "merge" if asTool).
+func runSubcommand(sc *subcommand, cmdName string, asTool bool, args []string) CmdStatus {
+	f := flag.NewFlagSet(cmdName, flag.ExitOnError)
+	// Include the flags registered with the flag package (i.e. those of glog).
+	flag.CommandLine.VisitAll(func(fl *flag.Flag) {
+		f.Var(fl.Value, fl.Name, fl.Usage)
+	})
+	var ci cmdInputs
+	ci.diffConfig.CreateFlags(f)
+	ci.opts.addConfigFlag(f)
+	sc.addFlags(f, &ci, asTool)
+	f.Usage = func() {
+		fmt.Fprintf(f.Output(), "Usage: %s [flags] %s\n\n%s\n\nFlags:\n",
+			cmdName, sc.args, sc.description)
+		f.PrintDefaults()
+	}
+	flag.Usage = f.Usage
+	f.Parse(args)
+	// glog complains if the flag package hasn't parsed the command line.
+	flag.CommandLine.Parse(nil)
+	glog.V(1).Infof("Running %s with args %q", cmdName, f.Args())
+
+	ci.finishFlags(f)
+	return sc.run(&ci, f.Args(), asTool)
+}
+
+// Runs the command line of older versions of diffmerge, without a subcommand,
+// where the behavior depends on the number of arguments and the flags.
+func runWithoutSubcommand(cmd string) CmdStatus {
+	var ci cmdInputs
+	ci.diffConfig.CreateFlags(flag.CommandLine)
+	ci.mergeConfig.CreateFlags(flag.CommandLine)
+	ci.opts.addBriefFlag(flag.CommandLine)
+	ci.opts.addFormatFlag(flag.CommandLine, "For diff of two files, the output "+
+		"format: \"text\" (as selected by the other flags), \"json\" (the matched "+
+		"and unmatched blocks, with a versioned schema), or \"html\" (a "+
+		"self-contained report, also supported with -diff3).")
+	ci.opts.addDiff2OutputFlags(flag.CommandLine)
+	ci.opts.addRecursiveFlag(flag.CommandLine)
+	ci.opts.addImportFlag(flag.CommandLine)
+	ci.opts.addGitMergeDriverFlag(flag.CommandLine)
+	ci.opts.addLabelsFlag(flag.CommandLine)
+	ci.opts.addConfigFlag(flag.CommandLine)
+	flag.BoolVar(&ci.opts.diff3, "diff3", false, "Find difference between 3 files.")
+	flag.StringVar(
+		&ci.opts.applyPatch, "apply", "", "Apply the unified diff in this file to "+
+			"the file argument, writing the result to the second file argument "+
+			"(if any) or to stdout.")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s <subcommand> [flags] <args>\n\nSubcommands:\n", cmd)
+		for _, sc := range subcommands {
+			fmt.Fprintf(out, "  %-6s %s\n", sc.name, sc.args)
+		}
+		fmt.Fprintf(out, "\nRun \"%s help <subcommand>\" for the flags of a subcommand.\n"+
+			"Without a subcommand, two files are compared (diff), and three are "+
+			"merged (merge, or diff3 with -diff3), with these flags:\n", cmd)
+		flag.PrintDefaults()
+	}
+	flag.Parse() // Scan the arguments list
+	ci.opts.checkFormat("text", "json", "html")
+	ci.finishFlags(flag.CommandLine)
 
 	nArgs := flag.NArg()
+	if ci.opts.applyPatch != "" {
+		if !(1 <= nArgs && nArgs <= 2) {
+			FailWithMessage(true, "Wrong number of file arguments for -apply")
+		}
+		ci.AddInputFile(flag.Arg(0))
+		if nArgs > 1 {
+			ci.outputFileName = flag.Arg(1)
+		}
+		return ci.PerformApply(ci.opts.applyPatch)
+	} else if ci.opts.importPatch != "" {
+		return findSubcommand("diff").run(&ci, flag.Args(), false)
+	} else if ci.opts.gitMergeDriver {
+		return findSubcommand("merge").run(&ci, flag.Args(), false)
+	} else if ci.opts.recursive {
+		if nArgs != 2 {
+			FailWithMessage(true, "-r requires two directory arguments")
+		}
+		return ci.PerformDirectoryDiff(flag.Arg(0), flag.Arg(1))
+	}
 	if !(2 <= nArgs && nArgs <= 4) {
 		FailWithMessage(true, "Wrong number of file arguments")
 	}
-	var ci cmdInputs
-	ci.diffConfig = *diffConfig
 	ci.AddInputFile(flag.Arg(0))
 	ci.AddInputFile(flag.Arg(1))
 	if nArgs > 2 {
@@ -297,14 +1066,40 @@ func main() {
 			ci.outputFileName = flag.Arg(3)
 		}
 	}
+	ci.ApplyLabels(ci.opts.labels)
 
-	var status CmdStatus
 	if nArgs == 2 {
-		status = ci.PerformDiff2()
-	} else if *pDiff3Flag {
-		status = ci.PerformDiff3()
+		return ci.PerformDiff2()
+	} else if ci.opts.diff3 {
+		return ci.PerformDiff3()
+	}
+	return ci.PerformMerge()
+}
+
+func isRegularFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func main() {
+	cmd := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+
+	var status CmdStatus
+	if sc := findSubcommand(cmd); sc != nil && sc.isTool {
+		// Invoked via a symlink named for the tool (e.g. diff3).
+		status = runSubcommand(sc, cmd, true, os.Args[1:])
+	} else if len(os.Args) > 1 && isRegularFile(os.Args[1]) {
+		// For compatibility with older versions, a file with the name of a
+		// subcommand is compared or merged, as before.
+		status = runWithoutSubcommand(cmd)
+	} else if len(os.Args) > 2 && os.Args[1] == "help" && findSubcommand(os.Args[2]) != nil {
+		status = runSubcommand(findSubcommand(os.Args[2]), cmd+" "+os.Args[2], false,
+			[]string{"-help"})
+	} else if len(os.Args) > 1 && findSubcommand(os.Args[1]) != nil {
+		sc := findSubcommand(os.Args[1])
+		status = runSubcommand(sc, cmd+" "+sc.name, false, os.Args[2:])
 	} else {
-		status = ci.PerformMerge()
+		status = runWithoutSubcommand(cmd)
 	}
 
 	os.Exit(int(status) & 0xff)
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLabelsFlag(t *testing.T) {
+	var o cmdOptions
+	f := flag.NewFlagSet("merge", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	o.addLabelsFlag(f)
+	if err := f.Parse([]string{"-L", "mine", "-L", "older", "-L", "yours"}); err != nil {
+		t.Fatalf("Failed to parse 3 labels: %s", err)
+	}
+	if got := strings.Join(o.labels, ","); got != "mine,older,yours" {
+		t.Errorf("Wrong labels: %s", got)
+	}
+	err := f.Parse([]string{"-L", "more"})
+	if err == nil || !strings.Contains(err.Error(), "at most 3 labels") {
+		t.Errorf("Expected an error for a 4th label, not: %v", err)
+	}
+}
+
+func TestOnlyInMessage(t *testing.T) {
+	aDir, bDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{"both/only_a", "both"} {
+		if err := os.MkdirAll(filepath.Join(aDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(bDir, "both"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	reported := make(map[string]bool)
+	for _, c := range []struct{ path, expected string }{
+		{"top", "Only in " + aDir + ": top"},
+		{"both/x", "Only in " + filepath.Join(aDir, "both") + ": x"},
+		{"both/only_a/y", "Only in " + filepath.Join(aDir, "both") + ": only_a"},
+		{"both/only_a/z", ""},
+	} {
+		if msg := onlyInMessage(aDir, bDir, c.path, reported); msg != c.expected {
+			t.Errorf("onlyInMessage(%q) returned %q, expected %q", c.path, msg, c.expected)
+		}
+	}
+}
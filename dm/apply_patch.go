@@ -0,0 +1,346 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Applies a FilePatch (e.g. from ParseUnifiedDiff) to a file which may have
+// changed since the patch was made. Rather than trusting the line numbers in
+// the hunk headers (as patch(1) does, searching outwards from them for the
+// context), the lines of each hunk are aligned with the file using the rare
+// lines they share (as for PerformDiff2), so that a hunk can be applied even
+// if the code it changes has since moved elsewhere in the file.
+//
+// A hunk is applied only if all of the lines it removes are found, unchanged
+// and in order, along with most of its context lines; the number of context
+// lines which may be missing or changed is the "fuzz" (MaxApplyFuzz).
+
+// The maximum number of context lines of a hunk which may be missing or
+// different in the target file.
+const MaxApplyFuzz = 2
+
+// The maximum number of candidate locations considered for each hunk.
+const maxApplyCandidates = 50
+
+type HunkResult struct {
+	Hunk *PatchHunk
+
+	// The one-based number of the hunk in the patch.
+	Number int
+
+	Applied bool
+
+	// Where the old lines of the hunk were found in the target file (the index
+	// of the line that corresponds to the first old line of the hunk), and its
+	// offset from where the hunk header said it would be.
+	Start, Offset int
+
+	// The number of context lines which were missing or different.
+	Fuzz int
+
+	// Why the hunk wasn't applied.
+	Reason string
+}
+
+func (p *HunkResult) String() string {
+	if !p.Applied {
+		return fmt.Sprintf("Hunk #%d FAILED at %d: %s.", p.Number, p.Hunk.OldStart+1, p.Reason)
+	}
+	s := fmt.Sprintf("Hunk #%d succeeded at %d", p.Number, p.Start+1)
+	if p.Offset != 0 {
+		if p.Offset == 1 || p.Offset == -1 {
+			s += fmt.Sprintf(" (offset %d line)", p.Offset)
+		} else {
+			s += fmt.Sprintf(" (offset %d lines)", p.Offset)
+		}
+	}
+	if p.Fuzz != 0 {
+		s += fmt.Sprintf(" with fuzz %d", p.Fuzz)
+	}
+	return s + "."
+}
+
+type ApplyResult struct {
+	// The body of the target file, with the hunks that could be placed applied.
+	Output []byte
+
+	Hunks []*HunkResult
+}
+
+func (p *ApplyResult) NumFailed() (count int) {
+	for _, hr := range p.Hunks {
+		if !hr.Applied {
+			count++
+		}
+	}
+	return
+}
+
+// Writes a line for each hunk, describing where it was applied or why it
+// wasn't.
+func (p *ApplyResult) FormatSummary(w io.Writer) error {
+	for _, hr := range p.Hunks {
+		if _, err := fmt.Fprintln(w, hr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A location at which a hunk could be applied: the lines [start, beyond) of
+// the target are replaced by replacement.
+type hunkPlacement struct {
+	start, beyond int
+	replacement   [][]byte
+
+	// The index of the line of the target corresponding to the first old line
+	// of the hunk (may be outside of [start, beyond) if leading context lines
+	// are missing).
+	hunkStart int
+
+	fuzz int
+}
+
+func (p *hunkPlacement) overlaps(o *hunkPlacement) bool {
+	if p.start == p.beyond || o.start == o.beyond {
+		// Insertions only conflict with edits that span the insertion point.
+		return o.start < p.start && p.start < o.beyond ||
+			p.start < o.start && o.start < p.beyond ||
+			p.start == o.start && p.beyond == o.beyond
+	}
+	return p.start < o.beyond && o.start < p.beyond
+}
+
+type patchApplier struct {
+	target   *File
+	config   DifferencerConfig
+	sf       SimilarityFactors
+	placed   []*hunkPlacement
+	lastDiff int
+}
+
+// Returns the SimilarityFactors for aligning the lines of a hunk with the
+// target, which are the same as PerformDiff2 uses, except that all lines
+// (not just rare ones) are aligned, because the hunk is short.
+func applySimilarityFactors(config DifferencerConfig) SimilarityFactors {
+	config.AlignRareLines = false
+	return diff2SimilarityFactors(config)
+}
+
+// Returns the candidate locations (the index in the target of the first old
+// line of the hunk) at which to try to place the hunk, nearest to expected
+// first. The candidates come from the rare lines shared by the hunk and the
+// target or, if there are none, from any lines they share.
+func (p *patchApplier) candidateStarts(hunkFile *File, expected int) []int {
+	seen := map[int]bool{expected: true}
+	starts := []int{expected}
+	add := func(hunkIndex, targetIndex int) {
+		start := targetIndex - hunkIndex
+		if !seen[start] {
+			seen[start] = true
+			starts = append(starts, start)
+		}
+	}
+	maxCountInRange := MaxInt(1, p.config.MaxRareLineOccurrencesInRange)
+	hunkRare, targetRare := FindRareLinesInRanges(
+		hunkFile.GetFullRange(), p.target.GetFullRange(),
+		false, false, false, maxCountInRange, 0)
+	if len(targetRare) > 0 {
+		for _, hlp := range hunkRare {
+			for _, tlp := range targetRare {
+				if hlp.Hash == tlp.Hash {
+					add(hlp.Index, tlp.Index)
+				}
+			}
+		}
+	} else {
+		targetPositions := p.target.GetFullRange().HashPositions()
+		for _, hlp := range hunkFile.Lines {
+			for _, targetIndex := range targetPositions[hlp.Hash] {
+				add(hlp.Index, targetIndex)
+			}
+		}
+	}
+	sort.SliceStable(starts, func(i, j int) bool {
+		return AbsInt(starts[i]-expected) < AbsInt(starts[j]-expected)
+	})
+	if len(starts) > maxApplyCandidates {
+		starts = starts[:maxApplyCandidates]
+	}
+	return starts
+}
+
+// Aligns the old lines of the hunk with the lines of the target near start,
+// and returns the resulting placement, or nil if the hunk can't be applied
+// there.
+func (p *patchApplier) placeHunkAt(hunk *PatchHunk, hunkFile *File, start int) *hunkPlacement {
+	numOld := hunkFile.LineCount()
+	wStart := MaxInt(0, start-MaxApplyFuzz)
+	wBeyond := MinInt(p.target.LineCount(), start+numOld+MaxApplyFuzz)
+	if wStart >= wBeyond {
+		return nil
+	}
+	frp := MakeFilePair(hunkFile, p.target).MakeSubRangePair(0, numOld, wStart, wBeyond-wStart)
+	lcsData := PerformLCS(frp, p.config, p.sf)
+	if lcsData == nil {
+		return nil
+	}
+	// The target line aligned with each old line of the hunk, or -1.
+	targetIndexOf := make([]int, numOld)
+	isExact := make([]bool, numOld)
+	for n := range targetIndexOf {
+		targetIndexOf[n] = -1
+	}
+	for _, pair := range lcsData.lcsPairs {
+		for i := 0; i < pair.ALength; i++ {
+			targetIndexOf[pair.AIndex+i] = pair.BIndex + i
+			isExact[pair.AIndex+i] = pair.IsMatch
+		}
+	}
+
+	placement := &hunkPlacement{start: -1}
+	oldIndex := 0
+	cursor := -1 // Index in target beyond the last line placed.
+	for _, line := range hunk.Lines {
+		if line.Op == '+' {
+			placement.replacement = append(placement.replacement, line.Text)
+			continue
+		}
+		targetIndex := targetIndexOf[oldIndex]
+		isRemoved := line.Op == '-'
+		oldIndex++
+		if targetIndex < 0 || (isRemoved && !isExact[oldIndex-1]) {
+			if isRemoved {
+				glog.V(1).Infof("Removed line %d of hunk %s not found near %d",
+					oldIndex, hunk.Header(), start)
+				return nil
+			}
+			placement.fuzz++
+			continue
+		}
+		if placement.start < 0 {
+			placement.start = targetIndex
+			placement.hunkStart = targetIndex - (oldIndex - 1)
+		} else {
+			// Keep any extra lines in the target between aligned lines, but
+			// count them against the fuzz.
+			for n := cursor; n < targetIndex; n++ {
+				placement.replacement = append(placement.replacement, p.target.GetLineBytes(n))
+				placement.fuzz++
+			}
+		}
+		if !isRemoved {
+			placement.replacement = append(placement.replacement, p.target.GetLineBytes(targetIndex))
+		}
+		cursor = targetIndex + 1
+	}
+	if placement.start < 0 || placement.fuzz > MaxApplyFuzz {
+		return nil
+	}
+	placement.beyond = cursor
+	return placement
+}
+
+func (p *patchApplier) overlapsPlaced(placement *hunkPlacement) bool {
+	for _, other := range p.placed {
+		if placement.overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *patchApplier) applyHunk(hunk *PatchHunk, number int) *HunkResult {
+	result := &HunkResult{Hunk: hunk, Number: number}
+	expected := hunk.OldStart + p.lastDiff
+	oldLines := hunk.OldLines()
+	var best *hunkPlacement
+	if len(oldLines) == 0 {
+		// Nothing to align, so insert where the header says, adjusted by the
+		// offset of the previous hunk.
+		start := MaxInt(0, MinInt(p.target.LineCount(), expected))
+		best = &hunkPlacement{start: start, beyond: start, hunkStart: start,
+			replacement: hunk.NewLines()}
+		if p.overlapsPlaced(best) {
+			best = nil
+		}
+	} else {
+		hunkFile, err := BuildFile("hunk", bytes.Join(oldLines, nil))
+		if err != nil {
+			result.Reason = err.Error()
+			return result
+		}
+		for _, start := range p.candidateStarts(hunkFile, expected) {
+			placement := p.placeHunkAt(hunk, hunkFile, start)
+			if placement == nil || p.overlapsPlaced(placement) {
+				continue
+			}
+			if best == nil || placement.fuzz < best.fuzz ||
+				(placement.fuzz == best.fuzz &&
+					AbsInt(placement.hunkStart-expected) < AbsInt(best.hunkStart-expected)) {
+				best = placement
+			}
+			if best.fuzz == 0 && best.hunkStart == expected {
+				break
+			}
+		}
+	}
+	if best == nil {
+		result.Reason = "unable to find the lines of the hunk in the file"
+		return result
+	}
+	p.placed = append(p.placed, best)
+	p.lastDiff = best.hunkStart - hunk.OldStart
+	result.Applied = true
+	result.Start = best.hunkStart
+	result.Offset = best.hunkStart - hunk.OldStart
+	result.Fuzz = best.fuzz
+	return result
+}
+
+// Returns the body of the target with the placed hunks applied.
+func (p *patchApplier) output() []byte {
+	placed := append([]*hunkPlacement(nil), p.placed...)
+	sort.SliceStable(placed, func(i, j int) bool {
+		return placed[i].start < placed[j].start
+	})
+	var buf bytes.Buffer
+	next := 0
+	for _, placement := range placed {
+		for ; next < placement.start; next++ {
+			buf.Write(p.target.GetLineBytes(next))
+		}
+		for _, line := range placement.replacement {
+			buf.Write(line)
+		}
+		next = MaxInt(next, placement.beyond)
+	}
+	for ; next < p.target.LineCount(); next++ {
+		buf.Write(p.target.GetLineBytes(next))
+	}
+	return buf.Bytes()
+}
+
+// Applies the hunks of the patch to the target. Hunks that can't be placed
+// (see HunkResult.Reason) are skipped; the others are still applied.
+func ApplyPatch(target *File, patch *FilePatch, config DifferencerConfig) *ApplyResult {
+	defer glog.Flush()
+	applier := &patchApplier{
+		target: target,
+		config: config,
+		sf:     applySimilarityFactors(config),
+	}
+	result := &ApplyResult{}
+	for n, hunk := range patch.Hunks {
+		hr := applier.applyHunk(hunk, n+1)
+		glog.Info(hr.String())
+		result.Hunks = append(result.Hunks, hr)
+	}
+	result.Output = applier.output()
+	return result
+}
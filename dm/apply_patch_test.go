@@ -0,0 +1,66 @@
+package dm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyPatchToMovedCode(t *testing.T) {
+	before, after := readTestFile(t, "swap_1234"), readTestFile(t, "swap_1234_edit_13")
+	cfg := DefaultDifferencerConfig()
+	diff := FormatUnifiedDiffToString(before, after, PerformDiff2(before, after, cfg), 1)
+	patches, err := ParseUnifiedDiffString(diff)
+	if err != nil {
+		t.Fatalf("Failed to parse unified diff: %s\n%s", err, diff)
+	}
+	if len(patches) != 1 || len(patches[0].Hunks) != 2 {
+		t.Fatalf("Expected 1 patch with 2 hunks, not:\n%s", diff)
+	}
+
+	// func2 and func3 have been swapped in the target, so the second hunk must
+	// be applied 4 lines earlier than the patch says.
+	target := readTestFile(t, "swap_1324")
+	result := ApplyPatch(target, patches[0], cfg)
+	if n := result.NumFailed(); n != 0 {
+		t.Fatalf("%d hunks failed", n)
+	}
+	expected := strings.Replace(string(target.Body), "x += 1\n", "x += 11\n", 1)
+	expected = strings.Replace(expected, "y += 3\n", "y += 33\n", 1)
+	if string(result.Output) != expected {
+		t.Errorf("Unexpected output:\n%s\nExpected:\n%s", result.Output, expected)
+	}
+	if hr := result.Hunks[1]; hr.Start != 4 || hr.Offset != -4 || hr.Fuzz != 0 {
+		t.Errorf("Unexpected placement of hunk 2: %s", hr)
+	}
+}
+
+func TestApplyPatchReportsFailedHunks(t *testing.T) {
+	patches, err := ParseUnifiedDiffString("--- a/swap_1234\n" +
+		"+++ b/swap_1234\n" +
+		"@@ -1,3 +1,3 @@\n" +
+		" void func1() {\n" +
+		"-  x += 1\n" +
+		"+  x += 11\n" +
+		" }\n" +
+		"@@ -13,3 +13,3 @@\n" +
+		" void func4() {\n" +
+		"-  z += 4\n" +
+		"+  z += 44\n" +
+		" }\n")
+	if err != nil {
+		t.Fatalf("Failed to parse unified diff: %s", err)
+	}
+	cfg := DefaultDifferencerConfig()
+	target := readTestFile(t, "swap_1234")
+	result := ApplyPatch(target, patches[0], cfg)
+	if n := result.NumFailed(); n != 1 || !result.Hunks[0].Applied {
+		t.Fatalf("Expected only hunk 2 to fail:\n%s\n%s", result.Hunks[0], result.Hunks[1])
+	}
+	if !strings.HasPrefix(result.Hunks[1].String(), "Hunk #2 FAILED at 13") {
+		t.Errorf("Unexpected result for hunk 2: %s", result.Hunks[1])
+	}
+	expected := strings.Replace(string(target.Body), "x += 1\n", "x += 11\n", 1)
+	if string(result.Output) != expected {
+		t.Errorf("Unexpected output:\n%s\nExpected:\n%s", result.Output, expected)
+	}
+}
@@ -21,6 +21,9 @@ type BlockPair struct {
 	IsMatch           bool
 	IsNormalizedMatch bool
 	IsMove            bool // Does this represent a move?
+	// If set (only for normalized matches), the lines differ only by this
+	// change to their indentation.
+	IndentationChange *IndentationChange
 }
 
 func IsSentinal(p *BlockPair) bool {
@@ -66,7 +69,8 @@ func BlockPairsLess(p, o *BlockPair) bool {
 
 func BlockPairsAreSameType(p, o *BlockPair) bool {
 	return (p.IsMatch == o.IsMatch && p.IsNormalizedMatch == o.IsNormalizedMatch &&
-		p.IsMove == o.IsMove && p.MoveId == o.MoveId)
+		p.IsMove == o.IsMove && p.MoveId == o.MoveId &&
+		indentationChangesAreEqual(p.IndentationChange, o.IndentationChange))
 }
 
 ////////////////////////////////////////////////////////////////////////////////
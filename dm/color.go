@@ -0,0 +1,128 @@
+package dm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Support for coloring the side-by-side and interleaved output with ANSI
+// escape sequences, so that the kind of each block (and, when available, the
+// changed tokens within changed lines) can be seen at a glance.
+
+// ANSI SGR escape sequences.
+const (
+	ansiReset     = "\x1b[0m"
+	ansiRed       = "\x1b[31m"
+	ansiGreen     = "\x1b[32m"
+	ansiYellow    = "\x1b[33m"
+	ansiMagenta   = "\x1b[35m"
+	ansiCyan      = "\x1b[36m"
+	ansiBold      = "\x1b[1m"
+	ansiReverse   = "\x1b[7m"
+	ansiNoReverse = "\x1b[27m"
+)
+
+// The environment variable which, if set to "always" or "never", overrides
+// the detection of whether the output is a terminal when the color mode is
+// "auto". As is conventional, if NO_COLOR is set (to any value), color is
+// not used in "auto" mode.
+const ColorEnvVar = "DIFFMERGE_COLOR"
+
+// Returns whether color should be used for output to f, given the value of
+// the -color flag ("auto", "always" or "never").
+func ShouldUseColor(mode string, f *os.File) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+	default:
+		return false, fmt.Errorf("invalid color mode %q (expected auto, always or never)", mode)
+	}
+	switch os.Getenv(ColorEnvVar) {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false, nil
+	}
+	if os.Getenv("TERM") == "dumb" {
+		return false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, nil
+	}
+	return fi.Mode()&os.ModeCharDevice != 0, nil
+}
+
+// Returns the color for the lines of A (or B) in a BlockPair with the
+// side-by-side code (see getCodeForBlockPair), or "" if they shouldn't be
+// colored.
+func colorForCode(code byte, isA bool) string {
+	switch code {
+	case '~', 'I':
+		return ansiCyan
+	case '!':
+		if isA {
+			return ansiRed
+		}
+		return ansiGreen
+	case '<':
+		return ansiRed
+	case '>':
+		return ansiGreen
+	case 'M', 'm':
+		return ansiMagenta
+	}
+	return ""
+}
+
+// Returns the text wrapped in the color, or the text unchanged if color is "".
+func colorize(text, color string) string {
+	if color == "" {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+// Returns the text wrapped in the color, with the bytes for which changed is
+// true shown in reverse video.
+func colorizeWithHighlights(text []byte, changed []bool, color string) string {
+	var sb strings.Builder
+	sb.WriteString(color)
+	highlighted := false
+	for n, b := range text {
+		isChanged := n < len(changed) && changed[n]
+		if isChanged != highlighted {
+			if isChanged {
+				sb.WriteString(ansiReverse)
+			} else {
+				sb.WriteString(ansiNoReverse)
+			}
+			highlighted = isChanged
+		}
+		sb.WriteByte(b)
+	}
+	sb.WriteString(ansiReset)
+	return sb.String()
+}
+
+// Returns a slice with an entry for each byte of a line of the given length,
+// true for those in the changed ranges.
+func changedBytesMask(length int, changedRanges []IndexPair) []bool {
+	if len(changedRanges) == 0 {
+		return nil
+	}
+	mask := make([]bool, length)
+	for _, cr := range changedRanges {
+		for n := MaxInt(0, cr.Index1); n < cr.Index2 && n < length; n++ {
+			mask[n] = true
+		}
+	}
+	return mask
+}
@@ -0,0 +1,66 @@
+package dm
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShouldUseColor(t *testing.T) {
+	for _, mode := range []string{"always", "never"} {
+		if use, err := ShouldUseColor(mode, os.Stdout); err != nil || use != (mode == "always") {
+			t.Errorf("ShouldUseColor(%q) returned %v, %v", mode, use, err)
+		}
+	}
+	if _, err := ShouldUseColor("sometimes", os.Stdout); err == nil {
+		t.Errorf("Expected an error for an invalid mode")
+	}
+	t.Setenv(ColorEnvVar, "always")
+	if use, _ := ShouldUseColor("auto", os.Stdout); !use {
+		t.Errorf("%s=always didn't override auto detection", ColorEnvVar)
+	}
+}
+
+func TestColoredSideBySideHighlightsChangedTokens(t *testing.T) {
+	lao, tzu, pairs := performTestDiff2(t, "lao", "tzu")
+	cfg := DefaultSideBySideConfig
+	cfg.Color = true
+	cfg.DisplayColumns = 120
+	var buf bytes.Buffer
+	FormatSideBySideWithIntraLineDiffs(lao, tzu, pairs, false,
+		PerformIntraLineDiff(lao, tzu, pairs), &buf, cfg)
+	s := buf.String()
+	for _, expected := range []string{
+		ansiRed + "     The " + ansiReverse + "Named" + ansiNoReverse + " is the mother",
+		ansiGreen + "     The " + ansiReverse + "named" + ansiNoReverse + " is the mother",
+		ansiBold + ansiYellow + "!" + ansiReset,
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("Colored side-by-side output is missing %q:\n%s", expected, s)
+		}
+	}
+	// Without color there must be no escape sequences.
+	cfg.Color = false
+	buf.Reset()
+	FormatSideBySideWithIntraLineDiffs(lao, tzu, pairs, false,
+		PerformIntraLineDiff(lao, tzu, pairs), &buf, cfg)
+	if strings.Contains(buf.String(), "\x1b") {
+		t.Errorf("Uncolored side-by-side output contains escape sequences:\n%s", buf.String())
+	}
+}
+
+func TestColoredInterleaved(t *testing.T) {
+	lao, tzu, pairs := performTestDiff2(t, "lao", "tzu")
+	var buf bytes.Buffer
+	err := FormatColoredInterleaved(pairs, false, lao, tzu,
+		PerformIntraLineDiff(lao, tzu, pairs), &buf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ansiGreen + "+" + ansiReset + "\t" + ansiGreen + "     The " +
+		ansiReverse + "named" + ansiNoReverse + " is the mother of all things." + ansiReset + "\n"
+	if s := buf.String(); !strings.Contains(s, expected) || strings.Contains(s, "^") {
+		t.Errorf("Unexpected colored interleaved output:\n%q", s)
+	}
+}
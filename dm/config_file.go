@@ -0,0 +1,256 @@
+package dm
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Supports reading the settings of DifferencerConfig from files, so that they
+// needn't be passed as flags every time, and so that they can be different
+// for different kinds of files. The names of the settings are those of the
+// flags created by DifferencerConfig.CreateFlags. For example:
+//
+//    # Applies to all files.
+//    max-rare-line-occurrences-in-file = 3
+//
+//    # Applies to files whose base name matches the glob.
+//    [*.go]
+//    omit-probably-common-lines = true
+//
+//    # Applies to files with this extension (i.e. the same as [*.md]).
+//    [.md]
+//    max-rare-line-occurrences-in-file = 5
+//    omit-probably-common-lines = false
+//
+// A section whose pattern contains a '/' is matched against the whole
+// (slash-separated) path of the file, rather than its base name. The settings
+// that apply to a file are those at the top of the file, followed by those of
+// each section that matches, in order, so later settings override earlier ones.
+
+// The name of the project config file, searched for in the current directory
+// and its ancestors.
+const ProjectConfigFileName = ".diffmerge"
+
+type ConfigSetting struct {
+	Name, Value string
+
+	// The line of the config file on which the setting appears.
+	Line int
+}
+
+type ConfigSection struct {
+	// The glob or extension (e.g. "*_test.go" or ".md") of the files to which
+	// the section applies, or "" for the settings at the top of the file,
+	// which apply to all files.
+	Pattern string
+
+	Settings []ConfigSetting
+}
+
+// Returns true if the settings of the section apply to the file.
+func (p *ConfigSection) Matches(fileName string) bool {
+	if p.Pattern == "" {
+		return true
+	}
+	pattern := p.Pattern
+	if strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "*?[/") {
+		pattern = "*" + pattern
+	}
+	name := filepath.ToSlash(fileName)
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+type ConfigFile struct {
+	// Where the settings came from, for messages.
+	Path string
+
+	// The settings at the top of the file (with Pattern ""), followed by the
+	// sections in the order they appear in the file.
+	Sections []*ConfigSection
+}
+
+// Returns the settings of the config file which apply to the file, in order.
+func (p *ConfigFile) SettingsFor(fileName string) (settings []ConfigSetting) {
+	for _, section := range p.Sections {
+		if section.Matches(fileName) {
+			settings = append(settings, section.Settings...)
+		}
+	}
+	return
+}
+
+// Sets the fields of config from the settings.
+func applyConfigSettings(config *DifferencerConfig, settings []ConfigSetting) error {
+	f := flag.NewFlagSet("config", flag.ContinueOnError)
+	config.createFlagsWithoutDefaults(f)
+	for _, setting := range settings {
+		if f.Lookup(setting.Name) == nil {
+			return fmt.Errorf("unknown setting %q", setting.Name)
+		}
+		if err := f.Set(setting.Name, setting.Value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", setting.Value, setting.Name, err)
+		}
+	}
+	return nil
+}
+
+// Registers the flags of config with f, without changing the fields of config
+// to the default values of the flags.
+func (p *DifferencerConfig) createFlagsWithoutDefaults(f *flag.FlagSet) {
+	saved := *p
+	p.CreateFlags(f)
+	*p = saved
+}
+
+// Parses the config file read from r; configPath is used in error messages. The
+// names and values of the settings are checked.
+func ParseConfigFile(r io.Reader, configPath string) (*ConfigFile, error) {
+	result := &ConfigFile{Path: configPath}
+	section := &ConfigSection{}
+	result.Sections = append(result.Sections, section)
+	var scratch DifferencerConfig
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return nil, fmt.Errorf("%s:%d: invalid section header: %s", configPath, lineNum, line)
+			}
+			section = &ConfigSection{Pattern: strings.TrimSpace(line[1 : len(line)-1])}
+			if _, err := path.Match(section.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q: %s", configPath, lineNum, section.Pattern, err)
+			}
+			result.Sections = append(result.Sections, section)
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected name = value: %s", configPath, lineNum, line)
+		}
+		setting := ConfigSetting{
+			Name:  strings.TrimSpace(line[:eq]),
+			Value: strings.TrimSpace(line[eq+1:]),
+			Line:  lineNum,
+		}
+		if err := applyConfigSettings(&scratch, []ConfigSetting{setting}); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", configPath, lineNum, err)
+		}
+		section.Settings = append(section.Settings, setting)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func ReadConfigFile(configPath string) (*ConfigFile, error) {
+	body, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigFile(bytes.NewReader(body), configPath)
+}
+
+// Returns the paths of the config files that exist, in increasing order of
+// precedence: the user's (diffmerge/config in the user's config directory,
+// e.g. ~/.config/diffmerge/config), then the project's (ProjectConfigFileName
+// in the current directory or the nearest of its ancestors).
+func FindConfigFiles() (paths []string) {
+	exists := func(configPath string) bool {
+		fi, err := os.Stat(configPath)
+		return err == nil && fi.Mode().IsRegular()
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		if configPath := filepath.Join(dir, "diffmerge", "config"); exists(configPath) {
+			paths = append(paths, configPath)
+		}
+	}
+	if dir, err := os.Getwd(); err == nil {
+		for {
+			if configPath := filepath.Join(dir, ProjectConfigFileName); exists(configPath) {
+				paths = append(paths, configPath)
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return
+}
+
+// Config files, in increasing order of precedence.
+type ConfigFiles []*ConfigFile
+
+func ReadConfigFiles(paths ...string) (ConfigFiles, error) {
+	var files ConfigFiles
+	for _, configPath := range paths {
+		file, err := ReadConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(1).Infof("Read config file %s", configPath)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Returns the DifferencerConfig for comparing the file (or files with the
+// same name), starting with the defaults of the flags, and applying the
+// settings of each config file in turn.
+func (s ConfigFiles) DifferencerConfigFor(fileName string) (DifferencerConfig, error) {
+	config := DefaultDifferencerConfig()
+	for _, file := range s {
+		if err := applyConfigSettings(&config, file.SettingsFor(fileName)); err != nil {
+			return config, fmt.Errorf("%s: %s", file.Path, err)
+		}
+	}
+	return config, nil
+}
+
+// Returns the DifferencerConfig for the file, with the settings from the
+// user's and the project's config files (see FindConfigFiles).
+func LoadDifferencerConfigFor(fileName string) (DifferencerConfig, error) {
+	files, err := ReadConfigFiles(FindConfigFiles()...)
+	if err != nil {
+		return DefaultDifferencerConfig(), err
+	}
+	return files.DifferencerConfigFor(fileName)
+}
+
+// Returns the config with the default values of the flags.
+func DefaultDifferencerConfig() (config DifferencerConfig) {
+	config.CreateFlags(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return
+}
+
+// Writes the settings of the config in the format of a config file.
+func FormatDifferencerConfig(config DifferencerConfig, w io.Writer) (err error) {
+	f := flag.NewFlagSet("config", flag.ContinueOnError)
+	config.createFlagsWithoutDefaults(f)
+	f.VisitAll(func(fl *flag.Flag) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s = %s\n", fl.Name, fl.Value.String())
+		}
+	})
+	return
+}
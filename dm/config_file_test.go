@@ -0,0 +1,92 @@
+package dm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testConfigFile = `
+# Applies to all files.
+max-rare-line-occurrences-in-file = 4
+
+[*.go]
+omit-probably-common-lines = false
+
+[.md]
+max-rare-line-occurrences-in-file = 7
+detect-block-moves = false
+
+[docs/*.md]
+match-ends = false
+`
+
+func TestDifferencerConfigFor(t *testing.T) {
+	file, err := ParseConfigFile(strings.NewReader(testConfigFile), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Sections) != 4 {
+		t.Fatalf("Expected 4 sections, got %d", len(file.Sections))
+	}
+	files := ConfigFiles{file}
+	defaults := DefaultDifferencerConfig()
+
+	config, err := files.DifferencerConfigFor("src/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxRareLineOccurrencesInFile != 4 || config.OmitProbablyCommonLines ||
+		!config.DetectBlockMoves || config.MatchEnds != defaults.MatchEnds {
+		t.Errorf("Unexpected config for main.go: %+v", config)
+	}
+
+	config, err = files.DifferencerConfigFor("docs/README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxRareLineOccurrencesInFile != 7 || !config.OmitProbablyCommonLines ||
+		config.DetectBlockMoves || config.MatchEnds {
+		t.Errorf("Unexpected config for docs/README.md: %+v", config)
+	}
+
+	config, err = files.DifferencerConfigFor("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.MatchEnds {
+		t.Errorf("Expected [docs/*.md] not to apply to README.md: %+v", config)
+	}
+
+	// The formatted config can be read back as a config file.
+	var buf bytes.Buffer
+	if err := FormatDifferencerConfig(config, &buf); err != nil {
+		t.Fatal(err)
+	}
+	file, err = ParseConfigFile(&buf, "formatted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := ConfigFiles{file}.DifferencerConfigFor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roundTrip != config {
+		t.Errorf("Formatted config read back as %+v, expected %+v", roundTrip, config)
+	}
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	for _, body := range []string{
+		"no-such-setting = 1\n",
+		"match-ends = maybe\n",
+		"[*.go\n",
+		"match-ends\n",
+	} {
+		if _, err := ParseConfigFile(strings.NewReader(body), "test"); err == nil {
+			t.Errorf("Expected an error parsing %q", body)
+		} else {
+			t.Log(err)
+		}
+	}
+}
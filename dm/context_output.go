@@ -0,0 +1,100 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Formats the differences between two files as a context diff, as produced
+// by "diff -c". As for FormatUnifiedDiff, moved lines are output as deleted
+// from their original location and inserted at their new location.
+
+// Formats a range of lines in the form used in context diff hunk headers:
+// "3" for just line 3, "3,6" for lines 3 through 6, and "2" for an empty
+// range after line 2.
+func formatContextRange(start, beyond int) string {
+	switch beyond - start {
+	case 0:
+		return fmt.Sprintf("%d", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, beyond)
+}
+
+// Writes the context diff, with contextLines of unchanged lines around each
+// change. Nothing is written if the files are the same.
+func FormatContextDiff(aFile, bFile *File, pairs BlockPairs, contextLines int,
+	w io.Writer) error {
+	_, changes := BaseAnchoredChanges(aFile, bFile, pairs)
+	hunks := groupChangesIntoHunks(aFile, bFile, changes, contextLines)
+	if len(hunks) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "*** %s\n--- %s\n",
+		aFile.DisplayName(), bFile.DisplayName()); err != nil {
+		return err
+	}
+	for _, hunk := range hunks {
+		if _, err := fmt.Fprintf(w, "***************\n*** %s ****\n",
+			formatContextRange(hunk.aStart, hunk.aBeyond)); err != nil {
+			return err
+		}
+		if err := writeContextHunkSide(w, aFile, hunk, true); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "--- %s ----\n",
+			formatContextRange(hunk.bStart, hunk.bBeyond)); err != nil {
+			return err
+		}
+		if err := writeContextHunkSide(w, bFile, hunk, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the lines of one of the files in the hunk, marking changed lines
+// with "! ", and deleted (or inserted) lines with "- " (or "+ "). If the file
+// has no such lines in the hunk, nothing is written.
+func writeContextHunkSide(w io.Writer, f *File, hunk *diffHunk, isA bool) error {
+	start, beyond, onlyPrefix := hunk.bStart, hunk.bBeyond, "+ "
+	if isA {
+		start, beyond, onlyPrefix = hunk.aStart, hunk.aBeyond, "- "
+	}
+	hasLines := false
+	for _, change := range hunk.changes {
+		if (isA && change.ALength > 0) || (!isA && change.BLength > 0) {
+			hasLines = true
+		}
+	}
+	if !hasLines {
+		return nil
+	}
+	index := start
+	for _, change := range hunk.changes {
+		changeStart, changeBeyond := change.BIndex, change.BBeyond()
+		if isA {
+			changeStart, changeBeyond = change.AIndex, change.ABeyond()
+		}
+		prefix := onlyPrefix
+		if change.ALength > 0 && change.BLength > 0 {
+			prefix = "! "
+		}
+		if err := writeIndentedLines(w, f, index, changeStart, "  "); err != nil {
+			return err
+		}
+		if err := writeIndentedLines(w, f, changeStart, changeBeyond, prefix); err != nil {
+			return err
+		}
+		index = changeBeyond
+	}
+	return writeIndentedLines(w, f, index, beyond, "  ")
+}
+
+func FormatContextDiffToString(aFile, bFile *File, pairs BlockPairs, contextLines int) string {
+	var buf bytes.Buffer
+	FormatContextDiff(aFile, bFile, pairs, contextLines, &buf)
+	return buf.String()
+}
@@ -0,0 +1,234 @@
+package dm
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Finds blocks of lines which were moved from one file to another, such as
+// when a large file is split into several. The lines of each file in tree A
+// which aren't matched in the corresponding file in tree B (i.e. which were
+// deleted, or the whole file if it was removed) are aligned with the
+// unmatched lines of the other files in tree B, using the same rare line LCS
+// as PerformMoveDetectionInGaps, and the alignments are chosen in order of
+// their MoveCandidate2 score. Only pairs of gaps which have in common a line
+// that is rare amongst all of the gaps of tree B are aligned.
+
+// The minimum number of matched lines in a block for it to be considered moved
+// to another file.
+const MinCrossFileMoveLines = 3
+
+type CrossFileMove struct {
+	Id int
+
+	// The entries of the file from which the block was moved (in tree A), and
+	// the file to which it was moved (in tree B).
+	AEntry, BEntry *DirEntryPair
+
+	// The matched lines of the block, with AIndex in AEntry.AFile, and BIndex
+	// in BEntry.BFile.
+	Pairs BlockPairs
+}
+
+func (p *CrossFileMove) ARange() (start, beyond int) {
+	limitsInA, _ := p.Pairs.LimitIndexPairs()
+	return limitsInA.Index1, limitsInA.Index2
+}
+
+func (p *CrossFileMove) BRange() (start, beyond int) {
+	_, limitsInB := p.Pairs.LimitIndexPairs()
+	return limitsInB.Index1, limitsInB.Index2
+}
+
+// Returns a description of the move for display with the file in tree A,
+// e.g. "Lines 10-20 moved to other_file.go:120".
+func (p *CrossFileMove) MovedToString() string {
+	aStart, aBeyond := p.ARange()
+	bStart, _ := p.BRange()
+	return fmt.Sprintf("Lines %s moved to %s:%d (move %d)",
+		formatLineRange(aStart, aBeyond), p.BEntry.Path, bStart+1, p.Id)
+}
+
+// Returns a description of the move for display with the file in tree B,
+// e.g. "Lines 120-130 moved from big_file.go:10".
+func (p *CrossFileMove) MovedFromString() string {
+	aStart, _ := p.ARange()
+	bStart, bBeyond := p.BRange()
+	return fmt.Sprintf("Lines %s moved from %s:%d (move %d)",
+		formatLineRange(bStart, bBeyond), p.AEntry.APathInTree(), aStart+1, p.Id)
+}
+
+// Extends the first and last of the pairs (sorted by AIndex) to include the
+// identical lines before and after them within the gaps, as the LCS only
+// aligns the rare lines at the ends of a block.
+func extendPairsWithinGaps(gapFRP FileRangePair, pairs BlockPairs) {
+	filePair := gapFRP.BaseFilePair()
+	aRange, bRange := gapFRP.ARange(), gapFRP.BRange()
+	first, last := pairs[0], pairs[len(pairs)-1]
+	for first.AIndex > aRange.FirstIndex() && first.BIndex > bRange.FirstIndex() {
+		if equal, _, _ := filePair.CompareFileLines(first.AIndex-1, first.BIndex-1, 0); !equal {
+			break
+		}
+		first.AIndex--
+		first.BIndex--
+		first.ALength++
+		first.BLength++
+	}
+	for last.ABeyond() < aRange.BeyondIndex() && last.BBeyond() < bRange.BeyondIndex() {
+		if equal, _, _ := filePair.CompareFileLines(last.ABeyond(), last.BBeyond(), 0); !equal {
+			break
+		}
+		last.ALength++
+		last.BLength++
+	}
+}
+
+// Returns the runs of lines in [0, lineCount) not in the set.
+func unmatchedRuns(lineCount int, matched IntervalSet) (runs []IndexPair) {
+	for n := 0; n < lineCount; {
+		if matched.Contains(n) {
+			n++
+			continue
+		}
+		start := n
+		for n < lineCount && !matched.Contains(n) {
+			n++
+		}
+		runs = append(runs, IndexPair{start, n})
+	}
+	return
+}
+
+func isMatchedBlockPair(pair *BlockPair) bool {
+	return pair.IsMatch || pair.IsNormalizedMatch
+}
+
+// Returns the moves between the files of the entries (from CompareDirectories),
+// in order of Id.
+func FindCrossFileMoves(entries []*DirEntryPair, config DifferencerConfig) []*CrossFileMove {
+	defer glog.Flush()
+	type gap struct {
+		entry *DirEntryPair
+		run   IndexPair
+	}
+	var aGaps, bGaps []gap
+	for _, entry := range entries {
+		if entry.AFile != nil {
+			matched := AIndexBlockPairsToIntervalSet(entry.Pairs, isMatchedBlockPair)
+			for _, run := range unmatchedRuns(entry.AFile.LineCount(), matched) {
+				aGaps = append(aGaps, gap{entry, run})
+			}
+		}
+		if entry.BFile != nil {
+			matched := BIndexBlockPairsToIntervalSet(entry.Pairs, isMatchedBlockPair)
+			for _, run := range unmatchedRuns(entry.BFile.LineCount(), matched) {
+				bGaps = append(bGaps, gap{entry, run})
+			}
+		}
+	}
+	glog.Infof("FindCrossFileMoves: %d gaps in A, %d gaps in B", len(aGaps), len(bGaps))
+
+	// Index the rare lines of all of the B gaps (by normalized hash, so that
+	// lines which differ only in white space are included), so that the LCS is
+	// only computed for pairs of gaps which have a rare line in common.
+	maxRareOccurrences := MaxInt(1, config.MaxRareLineOccurrencesInFile)
+	rareLineBGaps := make(map[uint32][]int)
+	hashCounts := make(map[uint32]int)
+	for j, bGap := range bGaps {
+		for n := bGap.run.Index1; n < bGap.run.Index2; n++ {
+			hash := bGap.entry.BFile.GetNormalizedHashOfLine(n)
+			hashCounts[hash]++
+			if gaps := rareLineBGaps[hash]; len(gaps) == 0 || gaps[len(gaps)-1] != j {
+				rareLineBGaps[hash] = append(gaps, j)
+			}
+		}
+	}
+	for hash, count := range hashCounts {
+		if count > maxRareOccurrences {
+			delete(rareLineBGaps, hash)
+		}
+	}
+
+	sf := diff2SimilarityFactors(config)
+	var candidates MoveCandidate2s
+	candidateEntries := make(map[*MoveCandidate2][2]*DirEntryPair)
+	numLCS := 0
+	for i, aGap := range aGaps {
+		sharesRareLine := make(map[int]bool)
+		for n := aGap.run.Index1; n < aGap.run.Index2; n++ {
+			for _, j := range rareLineBGaps[aGap.entry.AFile.GetNormalizedHashOfLine(n)] {
+				sharesRareLine[j] = true
+			}
+		}
+		for j, bGap := range bGaps {
+			if !sharesRareLine[j] || aGap.entry == bGap.entry {
+				// Moves within a file are found by PerformDiff2.
+				continue
+			}
+			filePair := MakeFilePair(aGap.entry.AFile, bGap.entry.BFile)
+			gapFRP := filePair.MakeSubRangePair(
+				aGap.run.Index1, aGap.run.Index2-aGap.run.Index1,
+				bGap.run.Index1, bGap.run.Index2-bGap.run.Index1)
+			numLCS++
+			lcsData := PerformLCS(gapFRP, config, sf)
+			if lcsData == nil || lcsData.numMatchedLines < MinCrossFileMoveLines {
+				continue
+			}
+			extendPairsWithinGaps(gapFRP, lcsData.lcsPairs)
+			mc := &MoveCandidate2{
+				aGapIndex: i,
+				bGapIndex: j,
+				gapFRP:    gapFRP,
+				lcsData:   lcsData,
+				crossFile: true,
+			}
+			candidates = append(candidates, mc)
+			candidateEntries[mc] = [2]*DirEntryPair{aGap.entry, bGap.entry}
+		}
+	}
+	glog.Infof("FindCrossFileMoves: computed the LCS of %d pairs of gaps", numLCS)
+	if len(candidates) == 0 {
+		return nil
+	}
+	candidates.SetScores()
+	sort.Stable(sort.Reverse(candidates))
+
+	// Lines of each file already in a move.
+	movedALines := make(map[*DirEntryPair]IntervalSet)
+	movedBLines := make(map[*DirEntryPair]IntervalSet)
+	overlaps := func(sets map[*DirEntryPair]IntervalSet, entry *DirEntryPair, start, beyond int) bool {
+		set := sets[entry]
+		if set == nil {
+			set = MakeIntervalSet()
+			sets[entry] = set
+		}
+		return set.ContainsSome(start, beyond)
+	}
+	var moves []*CrossFileMove
+	for _, mc := range candidates {
+		entries := candidateEntries[mc]
+		move := &CrossFileMove{AEntry: entries[0], BEntry: entries[1], Pairs: mc.lcsData.lcsPairs}
+		aStart, aBeyond := move.ARange()
+		bStart, bBeyond := move.BRange()
+		if overlaps(movedALines, move.AEntry, aStart, aBeyond) ||
+			overlaps(movedBLines, move.BEntry, bStart, bBeyond) {
+			continue
+		}
+		movedALines[move.AEntry].InsertInterval(aStart, aBeyond)
+		movedBLines[move.BEntry].InsertInterval(bStart, bBeyond)
+		moves = append(moves, move)
+	}
+	sort.SliceStable(moves, func(i, j int) bool {
+		if moves[i].AEntry != moves[j].AEntry {
+			return moves[i].AEntry.APathInTree() < moves[j].AEntry.APathInTree()
+		}
+		return moves[i].Pairs[0].AIndex < moves[j].Pairs[0].AIndex
+	})
+	for n, move := range moves {
+		move.Id = n + 1
+		glog.Infof("FindCrossFileMoves: %s", move.MovedToString())
+	}
+	return moves
+}
@@ -0,0 +1,100 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Format the changed Diff3Triples in the same format as the default output of
+// GNU diff3, where file 1 is yours, file 2 is base and file 3 is theirs:
+//
+//	====   all three files differ (a conflict)
+//	====1  only yours differs
+//	====2  only base differs (yours and theirs made the same change)
+//	====3  only theirs differs
+//
+// Each such header is followed by the affected range of lines in each file,
+// and the lines themselves (indented by two spaces); when two of the files
+// are the same, the lines are printed only once.
+func FormatDiff3(yours, base, theirs *File, triples Diff3Triples,
+	w io.Writer) error {
+	files := [3]*File{yours, base, theirs}
+	for _, triple := range triples {
+		var header string
+		var dontPrint int // Index of the file whose lines we don't print.
+		switch triple.TripleType {
+		case UnchangedTriple:
+			continue
+		case ConflictTriple:
+			header, dontPrint = "====", -1
+		case YoursChangedTriple:
+			header, dontPrint = "====1", 1
+		case BothSameTriple:
+			header, dontPrint = "====2", 0
+		case TheirsChangedTriple:
+			header, dontPrint = "====3", 0
+		}
+		if _, err := fmt.Fprintln(w, header); err != nil {
+			return err
+		}
+		ranges := [3]IndexPair{
+			{triple.B2YPair.BIndex, triple.B2YPair.BBeyond()},
+			{triple.BaseStart, triple.BaseBeyond},
+			{triple.B2TPair.BIndex, triple.B2TPair.BBeyond()},
+		}
+		for n, r := range ranges {
+			if _, err := fmt.Fprintf(w, "%d:%s\n", n+1, formatDiff3Range(r)); err != nil {
+				return err
+			}
+			if n == dontPrint {
+				continue
+			}
+			if err := writeIndentedLines(w, files[n], r.Index1, r.Index2, "  "); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func FormatDiff3ToString(yours, base, theirs *File, triples Diff3Triples) string {
+	var buf bytes.Buffer
+	FormatDiff3(yours, base, theirs, triples, &buf)
+	return buf.String()
+}
+
+// Formats the zero-based half-open range r in the one-based form used by
+// diff3: "3c" for one line, "3,5c" for several, or "2a" for an empty range
+// (i.e. after line 2).
+func formatDiff3Range(r IndexPair) string {
+	start, beyond := r.Index1, r.Index2
+	switch beyond - start {
+	case 0:
+		return fmt.Sprintf("%da", start)
+	case 1:
+		return fmt.Sprintf("%dc", start+1)
+	}
+	return fmt.Sprintf("%d,%dc", start+1, beyond)
+}
+
+// Writes the lines [start, beyond) of f, each preceded by prefix. If the last
+// line of the file lacks a newline, one is added, followed by the same
+// marker that diff(1) uses.
+func writeIndentedLines(w io.Writer, f *File, start, beyond int, prefix string) error {
+	for n := start; n < beyond; n++ {
+		line := f.GetLineBytes(n)
+		if _, err := io.WriteString(w, prefix); err != nil {
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			if _, err := io.WriteString(w, "\n\\ No newline at end of file\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package dm
+
+import (
+	"fmt"
+)
+
+// Summarizes the differences between two files (as for diffstat), by counting
+// the lines of each kind of BlockPair produced by PerformDiff2. Moved lines are
+// identified as for display (see findDisplayedMoves), so matches which are out
+// of order are counted as moved even if PerformDiff2 didn't mark them.
+
+type DiffStats struct {
+	ALines int `json:"a_lines"`
+	BLines int `json:"b_lines"`
+
+	// Lines of B which are identical to the corresponding lines of A, and
+	// which haven't moved.
+	UnchangedLines int `json:"unchanged_lines"`
+
+	// Lines of B which match the corresponding lines of A only after
+	// normalization (e.g. changes to white space), and which haven't moved;
+	// of these, IndentationChangedLines differ only in their indentation.
+	NormalizedMatchLines    int `json:"normalized_match_lines"`
+	IndentationChangedLines int `json:"indentation_changed_lines"`
+
+	// Lines of B matched with lines of A that were elsewhere in the file, and
+	// the number of distinct moves (blocks) they are in.
+	MovedLines int `json:"moved_lines"`
+	Moves      int `json:"moves"`
+
+	// Lines of A which aren't matched with lines of B, and vice versa.
+	DeletedLines  int `json:"deleted_lines"`
+	InsertedLines int `json:"inserted_lines"`
+}
+
+func ComputeDiffStats(aFile, bFile *File, pairs BlockPairs) *DiffStats {
+	stats := &DiffStats{ALines: aFile.LineCount(), BLines: bFile.LineCount()}
+	pairs = append(BlockPairs(nil), pairs...)
+	SortBlockPairsByBIndex(pairs)
+	dms := findDisplayedMoves(pairs, false)
+	matchedALines, matchedBLines := 0, 0
+	moves := make(map[*displayedMove]bool)
+	for _, pair := range pairs {
+		if !isMatchedBlockPair(pair) {
+			continue
+		}
+		matchedALines += pair.ALength
+		matchedBLines += pair.BLength
+		if move := dms.moveOfPair[pair]; move != nil {
+			stats.MovedLines += pair.BLength
+			moves[move] = true
+		} else if pair.IsMatch && !pair.IsNormalizedMatch {
+			stats.UnchangedLines += pair.BLength
+		} else {
+			stats.NormalizedMatchLines += pair.BLength
+			if pair.IndentationChange != nil {
+				stats.IndentationChangedLines += pair.BLength
+			}
+		}
+	}
+	stats.Moves = len(moves)
+	// Computed from the matched lines rather than the mismatched pairs, as not
+	// all unmatched lines are necessarily in a pair.
+	stats.DeletedLines = stats.ALines - matchedALines
+	stats.InsertedLines = stats.BLines - matchedBLines
+	return stats
+}
+
+func (p *DiffStats) HasDifferences() bool {
+	return p.DeletedLines > 0 || p.InsertedLines > 0 || p.MovedLines > 0 ||
+		p.NormalizedMatchLines > 0
+}
+
+// Returns a one line summary, e.g. "90 unchanged, 3 inserted(+), 2 deleted(-),
+// 12 moved (2 blocks), 4 changed white space (4 indentation only)".
+func (p *DiffStats) String() string {
+	return fmt.Sprintf("%d unchanged, %d inserted(+), %d deleted(-), "+
+		"%d moved (%d blocks), %d changed white space (%d indentation only)",
+		p.UnchangedLines, p.InsertedLines, p.DeletedLines, p.MovedLines, p.Moves,
+		p.NormalizedMatchLines, p.IndentationChangedLines)
+}
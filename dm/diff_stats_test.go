@@ -0,0 +1,26 @@
+package dm
+
+import (
+	"testing"
+)
+
+func TestComputeDiffStats(t *testing.T) {
+	aFile, bFile, pairs := performTestDiff2(t, "swap_1234", "swap_1324")
+	stats := ComputeDiffStats(aFile, bFile, pairs)
+	expected := DiffStats{
+		ALines:         15,
+		BLines:         15,
+		UnchangedLines: 11,
+		MovedLines:     4,
+		Moves:          1,
+	}
+	if *stats != expected {
+		t.Errorf("Wrong stats for swap_1234 => swap_1324:\n got: %+v\nwant: %+v", *stats, expected)
+	}
+
+	aFile, bFile, pairs = performTestDiff2(t, "lao", "lao")
+	stats = ComputeDiffStats(aFile, bFile, pairs)
+	if stats.HasDifferences() || stats.UnchangedLines != aFile.LineCount() {
+		t.Errorf("Expected no differences: %+v", stats)
+	}
+}
@@ -0,0 +1,332 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Compares two directory trees, as for "diff -r": the regular files of each
+// tree are paired by their path relative to the root of the tree, and each
+// pair of text files which differ is compared with PerformDiff2. Files which
+// are only in one of the trees are paired if their contents are similar
+// enough (i.e. the file was renamed), and blocks of lines which were moved
+// from one file to another are found (see FindCrossFileMoves).
+
+type DirEntryStatus int
+
+const (
+	FilesIdentical DirEntryStatus = iota
+	FilesDiffer
+	BinaryFilesDiffer
+	OnlyInA
+	OnlyInB
+	FileRenamed
+)
+
+func (s DirEntryStatus) String() string {
+	switch s {
+	case FilesIdentical:
+		return "identical"
+	case FilesDiffer:
+		return "differ"
+	case BinaryFilesDiffer:
+		return "binary_differ"
+	case OnlyInA:
+		return "only_in_a"
+	case OnlyInB:
+		return "only_in_b"
+	case FileRenamed:
+		return "renamed"
+	}
+	return fmt.Sprintf("DirEntryStatus(%d)", int(s))
+}
+
+type DirEntryPair struct {
+	// The path of the file relative to the roots of the trees, with '/' as the
+	// separator.
+	Path string
+
+	// If Status is FileRenamed, the relative path of the file in tree A (Path
+	// is that in tree B).
+	OldPath string
+
+	// The paths of the file in each tree, or "" if not present.
+	APath, BPath string
+
+	Status DirEntryStatus
+
+	// The text files, and their differences if Status is FilesDiffer or
+	// FileRenamed.
+	AFile, BFile *File
+	Pairs        BlockPairs
+}
+
+// Returns the relative path of the file in tree A.
+func (p *DirEntryPair) APathInTree() string {
+	if p.OldPath != "" {
+		return p.OldPath
+	}
+	return p.Path
+}
+
+type DirDiff struct {
+	ADir, BDir string
+
+	// The entries in order of Path.
+	Entries []*DirEntryPair
+
+	// The blocks of lines moved between files.
+	Moves []*CrossFileMove
+}
+
+// Returns true if any of the files differ, or are only in one of the trees.
+func (p *DirDiff) HasDifferences() bool {
+	for _, entry := range p.Entries {
+		if entry.Status != FilesIdentical {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the moves from the file of the entry to other files.
+func (p *DirDiff) MovesFrom(entry *DirEntryPair) (moves []*CrossFileMove) {
+	for _, move := range p.Moves {
+		if move.AEntry == entry {
+			moves = append(moves, move)
+		}
+	}
+	return
+}
+
+// Returns the moves to the file of the entry from other files.
+func (p *DirDiff) MovesTo(entry *DirEntryPair) (moves []*CrossFileMove) {
+	for _, move := range p.Moves {
+		if move.BEntry == entry {
+			moves = append(moves, move)
+		}
+	}
+	return
+}
+
+// Returns true if the body appears to be binary rather than text, i.e. if
+// there is a NUL byte near the start (as for diff and git).
+func IsBinary(body []byte) bool {
+	const numBytesToCheck = 8000
+	if len(body) > numBytesToCheck {
+		body = body[:numBytesToCheck]
+	}
+	return bytes.IndexByte(body, 0) >= 0
+}
+
+// Returns the slash-separated relative paths of the regular files in the
+// tree rooted at dir. As for diff -r, symlinks to regular files are treated
+// as those files; other symlinks (e.g. to directories, which could form
+// cycles) are skipped, with a warning.
+func listRegularFiles(dir string) (map[string]string, error) {
+	paths := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil {
+				glog.Warningf("Skipping broken symlink %s: %s", path, err)
+				return nil
+			}
+			if !target.Mode().IsRegular() {
+				glog.Warningf("Skipping symlink %s, which isn't to a regular file", path)
+				return nil
+			}
+			info = target
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths[filepath.ToSlash(rel)] = path
+		return nil
+	})
+	return paths, err
+}
+
+// The minimum similarity (see fileSimilarity) of a file only in tree A and a
+// file only in tree B for them to be treated as the same file, renamed.
+const RenameSimilarityThreshold = 0.5
+
+// Returns the fraction of the lines of the two files which are in both files.
+// An empty file has no similarity to any file, as otherwise unrelated empty
+// files (e.g. __init__.py) would be treated as renamed.
+func fileSimilarity(aFile, bFile *File) float64 {
+	if aFile.LineCount() == 0 || bFile.LineCount() == 0 {
+		return 0
+	}
+	total := aFile.LineCount() + bFile.LineCount()
+	counts := make(map[uint32]int)
+	for _, lp := range aFile.Lines {
+		counts[lp.Hash]++
+	}
+	common := 0
+	for _, lp := range bFile.Lines {
+		if counts[lp.Hash] > 0 {
+			counts[lp.Hash]--
+			common++
+		}
+	}
+	return float64(2*common) / float64(total)
+}
+
+// Pairs the text files only in tree A with the most similar text files only
+// in tree B, replacing each such pair of entries with a FileRenamed entry.
+func (p *DirDiff) detectRenames(configFor func(path string) DifferencerConfig) {
+	type candidate struct {
+		aEntry, bEntry *DirEntryPair
+		similarity     float64
+	}
+	var candidates []candidate
+	for _, aEntry := range p.Entries {
+		if aEntry.Status != OnlyInA || aEntry.AFile == nil {
+			continue
+		}
+		for _, bEntry := range p.Entries {
+			if bEntry.Status != OnlyInB || bEntry.BFile == nil {
+				continue
+			}
+			similarity := fileSimilarity(aEntry.AFile, bEntry.BFile)
+			if similarity >= RenameSimilarityThreshold {
+				candidates = append(candidates, candidate{aEntry, bEntry, similarity})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+	renamed := make(map[*DirEntryPair]bool)
+	for _, c := range candidates {
+		if renamed[c.aEntry] || renamed[c.bEntry] {
+			continue
+		}
+		renamed[c.aEntry], renamed[c.bEntry] = true, true
+		entry := c.bEntry
+		entry.Status = FileRenamed
+		entry.OldPath = c.aEntry.Path
+		entry.APath, entry.AFile = c.aEntry.APath, c.aEntry.AFile
+		entry.Pairs = PerformDiff2(entry.AFile, entry.BFile, configFor(entry.Path))
+		glog.Infof("detectRenames: %s renamed to %s (similarity %v)",
+			entry.OldPath, entry.Path, c.similarity)
+	}
+	var entries []*DirEntryPair
+	for _, entry := range p.Entries {
+		if !(renamed[entry] && entry.Status == OnlyInA) {
+			entries = append(entries, entry)
+		}
+	}
+	p.Entries = entries
+}
+
+// Reads the file, returning nil if it isn't a text file.
+func readTextFile(path string) (*File, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil || IsBinary(body) {
+		return nil, err
+	}
+	return BuildFile(path, body)
+}
+
+// Compares the pair of files in the two trees, setting entry.Status, and
+// entry.Pairs if they're text files which differ.
+func compareDirEntryPair(entry *DirEntryPair, config DifferencerConfig) error {
+	aBody, err := ioutil.ReadFile(entry.APath)
+	if err != nil {
+		return err
+	}
+	bBody, err := ioutil.ReadFile(entry.BPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(aBody, bBody) {
+		entry.Status = FilesIdentical
+		return nil
+	}
+	if IsBinary(aBody) || IsBinary(bBody) {
+		entry.Status = BinaryFilesDiffer
+		return nil
+	}
+	entry.Status = FilesDiffer
+	if entry.AFile, err = BuildFile(entry.APath, aBody); err != nil {
+		return err
+	}
+	if entry.BFile, err = BuildFile(entry.BPath, bBody); err != nil {
+		return err
+	}
+	entry.Pairs = PerformDiff2(entry.AFile, entry.BFile, config)
+	return nil
+}
+
+// Compares the trees rooted at aDir and bDir.
+func CompareDirectories(aDir, bDir string, config DifferencerConfig) (*DirDiff, error) {
+	return CompareDirectoriesUsing(aDir, bDir, func(string) DifferencerConfig {
+		return config
+	})
+}
+
+// Compares the trees rooted at aDir and bDir, comparing each pair of files
+// with the config returned by configFor for its relative path (e.g. from
+// ConfigFiles.DifferencerConfigFor). The moves between files are found using
+// the config for the path "" (i.e. the settings for all files).
+func CompareDirectoriesUsing(aDir, bDir string,
+	configFor func(path string) DifferencerConfig) (*DirDiff, error) {
+	aPaths, err := listRegularFiles(aDir)
+	if err != nil {
+		return nil, err
+	}
+	bPaths, err := listRegularFiles(bDir)
+	if err != nil {
+		return nil, err
+	}
+	result := &DirDiff{ADir: aDir, BDir: bDir}
+	for rel, aPath := range aPaths {
+		result.Entries = append(result.Entries, &DirEntryPair{
+			Path: rel, APath: aPath, BPath: bPaths[rel], Status: OnlyInA,
+		})
+	}
+	for rel, bPath := range bPaths {
+		if _, ok := aPaths[rel]; !ok {
+			result.Entries = append(result.Entries, &DirEntryPair{
+				Path: rel, BPath: bPath, Status: OnlyInB,
+			})
+		}
+	}
+	sort.Slice(result.Entries, func(i, j int) bool {
+		return result.Entries[i].Path < result.Entries[j].Path
+	})
+	for _, entry := range result.Entries {
+		switch {
+		case entry.BPath == "":
+			entry.AFile, err = readTextFile(entry.APath)
+		case entry.APath == "":
+			entry.BFile, err = readTextFile(entry.BPath)
+		default:
+			err = compareDirEntryPair(entry, configFor(entry.Path))
+		}
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("CompareDirectories: %s %s", entry.Path, entry.Status)
+	}
+	result.detectRenames(configFor)
+	if config := configFor(""); config.DetectBlockMoves {
+		result.Moves = FindCrossFileMoves(result.Entries, config)
+	}
+	return result, nil
+}
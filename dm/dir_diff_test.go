@@ -0,0 +1,155 @@
+package dm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestTree(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for rel, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCompareDirectories(t *testing.T) {
+	aDir := writeTestTree(t, map[string]string{
+		"same":    "a\nb\n",
+		"sub/x":   "a\nb\nc\n",
+		"removed": "r\n",
+		"bin":     "a\x00b",
+	})
+	bDir := writeTestTree(t, map[string]string{
+		"same":  "a\nb\n",
+		"sub/x": "a\nB\nc\n",
+		"added": "n\n",
+		"bin":   "a\x00c",
+	})
+	cfg := DefaultDifferencerConfig()
+	dirDiff, err := CompareDirectories(aDir, bDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path   string
+		status DirEntryStatus
+	}{
+		{"added", OnlyInB},
+		{"bin", BinaryFilesDiffer},
+		{"removed", OnlyInA},
+		{"same", FilesIdentical},
+		{"sub/x", FilesDiffer},
+	}
+	if len(dirDiff.Entries) != len(expected) {
+		t.Fatalf("Expected %d entries, not %d", len(expected), len(dirDiff.Entries))
+	}
+	for n, e := range expected {
+		if entry := dirDiff.Entries[n]; entry.Path != e.path || entry.Status != e.status {
+			t.Errorf("Entries[%d] is %s (%s), expected %s (%s)",
+				n, entry.Path, entry.Status, e.path, e.status)
+		}
+	}
+	entry := dirDiff.Entries[4]
+	SortBlockPairsByAIndex(entry.Pairs)
+	if len(entry.Pairs) != 3 || entry.Pairs[1].IsMatch || entry.Pairs[1].AIndex != 1 {
+		t.Errorf("Unexpected pairs for sub/x:\n%s", FormatSideBySideToString(
+			entry.AFile, entry.BFile, entry.Pairs, false, DefaultSideBySideConfig))
+	}
+	if !dirDiff.HasDifferences() {
+		t.Errorf("Expected differences")
+	}
+}
+
+// Symlinks to files are compared as the files, as by diff -r; other symlinks
+// are skipped.
+func TestCompareDirectoriesFollowsSymlinksToFiles(t *testing.T) {
+	aDir := writeTestTree(t, map[string]string{"real": "a\nb\n", "sub/x": "x\n"})
+	bDir := writeTestTree(t, map[string]string{"real": "a\nb\n", "link": "a\nb\n"})
+	for link, target := range map[string]string{"link": "real", "dir": "sub", "broken": "missing"} {
+		if err := os.Symlink(target, filepath.Join(aDir, link)); err != nil {
+			t.Skipf("Can't create symlinks: %s", err)
+		}
+	}
+	cfg := DefaultDifferencerConfig()
+	dirDiff, err := CompareDirectories(aDir, bDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]DirEntryStatus)
+	for _, entry := range dirDiff.Entries {
+		statuses[entry.Path] = entry.Status
+	}
+	if len(statuses) != 3 || statuses["link"] != FilesIdentical ||
+		statuses["real"] != FilesIdentical || statuses["sub/x"] != OnlyInA {
+		t.Errorf("Unexpected entries: %v", statuses)
+	}
+}
+
+// Unrelated empty files aren't treated as renamed.
+func TestCompareDirectoriesDoesNotRenameEmptyFiles(t *testing.T) {
+	aDir := writeTestTree(t, map[string]string{"pkg/a/__init__.py": ""})
+	bDir := writeTestTree(t, map[string]string{"other/b/__init__.py": ""})
+	dirDiff, err := CompareDirectories(aDir, bDir, DefaultDifferencerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirDiff.Entries) != 2 || dirDiff.Entries[0].Status != OnlyInB ||
+		dirDiff.Entries[1].Status != OnlyInA {
+		for _, entry := range dirDiff.Entries {
+			t.Errorf("Unexpected entry: %s (%s)", entry.Path, entry.Status)
+		}
+	}
+}
+
+func TestCompareDirectoriesFindsRenamesAndMoves(t *testing.T) {
+	funcs := []string{
+		"func alpha() {\n\tx := 1\n\tfmt.Println(x)\n}\n",
+		"func beta() {\n\ta := compute(7)\n\tb := transform(a)\n\treturn b\n}\n",
+		"func gamma() {\n\tfor i := 0; i < 10; i++ {\n\t\tprocess(i)\n\t}\n}\n",
+	}
+	aDir := writeTestTree(t, map[string]string{
+		"big.go":       "package big\n\n" + funcs[0] + "\n" + funcs[1] + "\n" + funcs[2],
+		"old_name.txt": "line one\nline two\nline three\nline four\n",
+	})
+	bDir := writeTestTree(t, map[string]string{
+		"big.go":       "package big\n\n" + funcs[0],
+		"split.go":     "package big\n\n" + funcs[1] + "\n" + funcs[2],
+		"new_name.txt": "line one\nline two\nline three\nline 4\n",
+	})
+	cfg := DefaultDifferencerConfig()
+	dirDiff, err := CompareDirectories(aDir, bDir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirDiff.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, not %d", len(dirDiff.Entries))
+	}
+	renamed := dirDiff.Entries[1]
+	if renamed.Path != "new_name.txt" || renamed.OldPath != "old_name.txt" ||
+		renamed.Status != FileRenamed {
+		t.Errorf("Expected old_name.txt to be renamed to new_name.txt, not %s (%s)",
+			renamed.Path, renamed.Status)
+	}
+	if len(dirDiff.Moves) != 1 {
+		t.Fatalf("Expected 1 move, not %d", len(dirDiff.Moves))
+	}
+	move := dirDiff.Moves[0]
+	if s := move.MovedToString(); s != "Lines 7-18 moved to split.go:2 (move 1)" {
+		t.Errorf("Unexpected move: %s", s)
+	}
+	if s := move.MovedFromString(); s != "Lines 2-13 moved from big.go:7 (move 1)" {
+		t.Errorf("Unexpected move: %s", s)
+	}
+	if moves := dirDiff.MovesTo(dirDiff.Entries[2]); len(moves) != 1 || moves[0] != move {
+		t.Errorf("Expected the move to split.go")
+	}
+}
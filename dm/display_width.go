@@ -0,0 +1,121 @@
+package dm
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Computes the number of columns that text occupies on a terminal with a
+// mono-spaced font: most characters occupy one column, East Asian wide and
+// fullwidth characters (e.g. CJK ideographs, Hangul, fullwidth forms and
+// most emoji) occupy two, and combining marks and other zero-width
+// characters occupy none (they are drawn over the preceding character).
+
+// Ranges of code points with East Asian Width W or F (per Unicode's
+// EastAsianWidth.txt), merged where adjacent, and sorted.
+var wideRuneRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115F},   // Hangul Jamo initial consonants
+	{0x231A, 0x231B},   // Watch, hourglass
+	{0x2329, 0x232A},   // Angle brackets
+	{0x23E9, 0x23EC},   // Media control symbols
+	{0x23F0, 0x23F0},   // Alarm clock
+	{0x23F3, 0x23F3},   // Hourglass with flowing sand
+	{0x25FD, 0x25FE},   // Medium small squares
+	{0x2614, 0x2615},   // Umbrella, hot beverage
+	{0x2648, 0x2653},   // Zodiac symbols
+	{0x267F, 0x267F},   // Wheelchair symbol
+	{0x2693, 0x2693},   // Anchor
+	{0x26A1, 0x26A1},   // High voltage
+	{0x26AA, 0x26AB},   // Medium circles
+	{0x26BD, 0x26BE},   // Soccer ball, baseball
+	{0x26C4, 0x26C5},   // Snowman, sun behind cloud
+	{0x26CE, 0x26CE},   // Ophiuchus
+	{0x26D4, 0x26D4},   // No entry
+	{0x26EA, 0x26EA},   // Church
+	{0x26F2, 0x26F3},   // Fountain, golf
+	{0x26F5, 0x26F5},   // Sailboat
+	{0x26FA, 0x26FA},   // Tent
+	{0x26FD, 0x26FD},   // Fuel pump
+	{0x2705, 0x2705},   // Check mark button
+	{0x270A, 0x270B},   // Raised fists
+	{0x2728, 0x2728},   // Sparkles
+	{0x274C, 0x274C},   // Cross mark
+	{0x274E, 0x274E},   // Cross mark button
+	{0x2753, 0x2755},   // Question and exclamation marks
+	{0x2757, 0x2757},   // Exclamation mark
+	{0x2795, 0x2797},   // Plus, minus, divide
+	{0x27B0, 0x27B0},   // Curly loop
+	{0x27BF, 0x27BF},   // Double curly loop
+	{0x2B1B, 0x2B1C},   // Large squares
+	{0x2B50, 0x2B50},   // Star
+	{0x2B55, 0x2B55},   // Heavy large circle
+	{0x2E80, 0x303E},   // CJK radicals, Kangxi radicals, CJK symbols and punctuation
+	{0x3041, 0x33FF},   // Hiragana, Katakana, Bopomofo, Hangul compatibility Jamo, ...
+	{0x3400, 0x4DBF},   // CJK unified ideographs extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi syllables and radicals
+	{0xA960, 0xA97F},   // Hangul Jamo extended A
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE10, 0xFE19},   // Vertical forms
+	{0xFE30, 0xFE6F},   // CJK compatibility forms, small form variants
+	{0xFF00, 0xFF60},   // Fullwidth forms
+	{0xFFE0, 0xFFE6},   // Fullwidth signs
+	{0x16FE0, 0x16FE4}, // Ideographic symbols and punctuation
+	{0x17000, 0x18AFF}, // Tangut
+	{0x1B000, 0x1B2FF}, // Kana supplement and extensions, Nushu
+	{0x1F004, 0x1F004}, // Mahjong tile red dragon
+	{0x1F0CF, 0x1F0CF}, // Playing card black joker
+	{0x1F18E, 0x1F18E}, // Negative squared AB
+	{0x1F191, 0x1F19A}, // Squared CL through VS
+	{0x1F200, 0x1F2FF}, // Enclosed ideographic supplement
+	{0x1F300, 0x1F64F}, // Miscellaneous symbols and pictographs, emoticons
+	{0x1F680, 0x1F6FF}, // Transport and map symbols
+	{0x1F7E0, 0x1F7EB}, // Large colored circles and squares
+	{0x1F90C, 0x1F9FF}, // Supplemental symbols and pictographs
+	{0x1FA70, 0x1FAFF}, // Symbols and pictographs extended A
+	{0x20000, 0x2FFFD}, // CJK unified ideographs extensions B-F, ...
+	{0x30000, 0x3FFFD}, // CJK unified ideographs extension G, ...
+}
+
+func isWideRune(r rune) bool {
+	lo, hi := 0, len(wideRuneRanges)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if r < wideRuneRanges[mid].lo {
+			hi = mid
+		} else if r > wideRuneRanges[mid].hi {
+			lo = mid + 1
+		} else {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of columns occupied by the rune, which must be
+// printable (i.e. not a control character).
+func RuneWidth(r rune) int {
+	switch {
+	case r == 0x200B || (0x1160 <= r && r <= 0x11FF):
+		// Zero width space, and Hangul Jamo medial vowels and final consonants
+		// (which combine with the preceding initial consonant).
+		return 0
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case isWideRune(r):
+		return 2
+	}
+	return 1
+}
+
+// Returns the number of columns occupied by the text, which is assumed to
+// contain only printable characters.
+func StringWidth(text []byte) (width int) {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		width += RuneWidth(r)
+		text = text[size:]
+	}
+	return
+}
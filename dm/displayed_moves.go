@@ -0,0 +1,132 @@
+package dm
+
+// Identifies the moved blocks in the BlockPairs produced by PerformDiff2, for
+// display by FormatInterleaved and FormatHTMLSideBySide. The output of those
+// is in the order of one of the files (the primary), so a moved block is
+// displayed at its location in the primary, and its location in the other
+// (secondary) file is marked separately.
+
+type displayedMove struct {
+	// The id to display: the MoveId of the first pair, if it has one.
+	id int
+
+	// The pairs of the block, in display order, including those with edits
+	// between the matched lines of the block.
+	pairs BlockPairs
+
+	// The lines of the block in each file.
+	aStart, aBeyond int
+	bStart, bBeyond int
+}
+
+// Returns the lines of the block in the secondary file.
+func (p *displayedMove) secondaryRange(aIsPrimary bool) (start, beyond int) {
+	if aIsPrimary {
+		return p.bStart, p.bBeyond
+	}
+	return p.aStart, p.aBeyond
+}
+
+type displayedMoves struct {
+	// The move of each pair that is part of a moved block.
+	moveOfPair map[*BlockPair]*displayedMove
+
+	// The moved blocks whose location in the secondary file is just before
+	// the pair with the index (in display order), or len(pairs) if at the end.
+	movedAwayBefore map[int][]*displayedMove
+}
+
+// Finds the moved blocks in pairs, which must be sorted in display order (by
+// AIndex if aIsPrimary, else by BIndex). PerformDiff2 doesn't always mark
+// moved blocks, so those matches which aren't in order (i.e. aren't in the
+// longest ordered chain of matches) are also treated as moved.
+func findDisplayedMoves(pairs BlockPairs, aIsPrimary bool) *displayedMoves {
+	var matches BlockPairs
+	for _, pair := range pairs {
+		if pair.IsMatch || pair.IsNormalizedMatch {
+			matches = append(matches, pair)
+		}
+	}
+	SortBlockPairsByAIndex(matches)
+	isMoved := make(map[*BlockPair]bool)
+	for _, pair := range matches {
+		isMoved[pair] = true
+	}
+	for _, pair := range longestOrderedChain(matches) {
+		isMoved[pair] = pair.IsMove
+	}
+
+	// Are the pairs adjacent in both files?
+	adjacent := func(prev, next *BlockPair) bool {
+		return prev.ABeyond() == next.AIndex && prev.BBeyond() == next.BIndex
+	}
+	result := &displayedMoves{
+		moveOfPair:      make(map[*BlockPair]*displayedMove),
+		movedAwayBefore: make(map[int][]*displayedMove),
+	}
+	var moves []*displayedMove
+	var move *displayedMove
+	for n := 0; n < len(pairs); n++ {
+		pair := pairs[n]
+		if !isMoved[pair] {
+			move = nil
+			continue
+		}
+		if move == nil || !adjacent(move.pairs[len(move.pairs)-1], pair) ||
+			(pair.MoveId != 0 && move.pairs[0].MoveId != 0 && pair.MoveId != move.pairs[0].MoveId) {
+			id := pair.MoveId
+			if id == 0 {
+				id = n + 1
+			}
+			move = &displayedMove{id: id, aStart: pair.AIndex, bStart: pair.BIndex}
+			moves = append(moves, move)
+		}
+		move.pairs = append(move.pairs, pair)
+		move.aBeyond, move.bBeyond = pair.ABeyond(), pair.BBeyond()
+		result.moveOfPair[pair] = move
+
+		// Include the edits between this pair and the next moved pair of the
+		// block, if there is one.
+		m := n + 1
+		for m < len(pairs) && !isMoved[pairs[m]] && !(pairs[m].IsMatch || pairs[m].IsNormalizedMatch) &&
+			adjacent(pairs[m-1], pairs[m]) {
+			m++
+		}
+		if m > n+1 && m < len(pairs) && isMoved[pairs[m]] && adjacent(pairs[m-1], pairs[m]) {
+			for _, edit := range pairs[n+1 : m] {
+				move.pairs = append(move.pairs, edit)
+				result.moveOfPair[edit] = move
+			}
+			n = m - 1
+		}
+	}
+
+	// Mark the location of each move in the secondary file: just before the
+	// next unmoved pair in that file.
+	pairIndex := make(map[*BlockPair]int)
+	for n, pair := range pairs {
+		pairIndex[pair] = n
+	}
+	secondary := append(BlockPairs(nil), pairs...)
+	if aIsPrimary {
+		SortBlockPairsByBIndex(secondary)
+	} else {
+		SortBlockPairsByAIndex(secondary)
+	}
+	for _, move := range moves {
+		_, beyond := move.secondaryRange(aIsPrimary)
+		before := len(pairs)
+		for _, next := range secondary {
+			start := next.AIndex
+			if aIsPrimary {
+				start = next.BIndex
+			}
+			if result.moveOfPair[next] == nil && start >= beyond {
+				before = pairIndex[next]
+				break
+			}
+		}
+		result.movedAwayBefore[before] = append(result.movedAwayBefore[before], move)
+	}
+	return result
+}
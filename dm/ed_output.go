@@ -0,0 +1,111 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Formats the differences between two files as an ed script (as produced by
+// "diff -e"), or in RCS format (as produced by "diff -n"). As for
+// FormatUnifiedDiff, moved lines are output as deleted from their original
+// location and inserted at their new location.
+
+// Formats the zero-based range [start, beyond) as one-based line numbers,
+// in the form used by ed: "3" or "3,5".
+func formatEdRange(start, beyond int) string {
+	if beyond-start <= 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, beyond)
+}
+
+// Writes an ed script which transforms aFile into bFile. The commands are
+// in reverse order so that the line numbers of each refer to the original
+// lines of aFile.
+func FormatEdScript(aFile, bFile *File, pairs BlockPairs, w io.Writer) error {
+	_, changes := BaseAnchoredChanges(aFile, bFile, pairs)
+	for n := len(changes) - 1; n >= 0; n-- {
+		change := changes[n]
+		var err error
+		if change.ALength == 0 {
+			_, err = fmt.Fprintf(w, "%da\n", change.AIndex)
+		} else if change.BLength == 0 {
+			_, err = fmt.Fprintf(w, "%sd\n", formatEdRange(change.AIndex, change.ABeyond()))
+		} else {
+			_, err = fmt.Fprintf(w, "%sc\n", formatEdRange(change.AIndex, change.ABeyond()))
+		}
+		if err != nil {
+			return err
+		}
+		if change.BLength > 0 {
+			if err := writeEdLines(w, bFile, change.BIndex, change.BBeyond()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Writes the lines to be inserted by an ed command, followed by the line
+// with just a period that ends insert mode. A line which is itself just a
+// period would end insert mode, so it is written as two periods, which are
+// then replaced with one, as GNU diff does.
+func writeEdLines(w io.Writer, f *File, start, beyond int) error {
+	insertMode := true
+	for n := start; n < beyond; n++ {
+		line := f.GetLineBytes(n)
+		if !insertMode {
+			if _, err := io.WriteString(w, "a\n"); err != nil {
+				return err
+			}
+			insertMode = true
+		}
+		if bytes.Equal(bytes.TrimSuffix(line, []byte("\n")), []byte(".")) {
+			if _, err := io.WriteString(w, "..\n.\ns/.//\n"); err != nil {
+				return err
+			}
+			insertMode = false
+			continue
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	if insertMode {
+		if _, err := io.WriteString(w, ".\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the differences in RCS format: "dN C" deletes C lines starting at
+// line N of aFile, and "aN C" adds the following C lines after line N of
+// aFile. The commands are in order.
+func FormatRCSDiff(aFile, bFile *File, pairs BlockPairs, w io.Writer) error {
+	_, changes := BaseAnchoredChanges(aFile, bFile, pairs)
+	for _, change := range changes {
+		if change.ALength > 0 {
+			if _, err := fmt.Fprintf(w, "d%d %d\n", change.AIndex+1, change.ALength); err != nil {
+				return err
+			}
+		}
+		if change.BLength > 0 {
+			if _, err := fmt.Fprintf(w, "a%d %d\n", change.ABeyond(), change.BLength); err != nil {
+				return err
+			}
+			for n := change.BIndex; n < change.BBeyond(); n++ {
+				if _, err := w.Write(bFile.GetLineBytes(n)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
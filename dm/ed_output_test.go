@@ -0,0 +1,67 @@
+package dm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatContextDiff(t *testing.T) {
+	lao, tzu, pairs := performTestDiff2(t, "lao", "tzu")
+	expected := "*** ../data/lao\n" +
+		"--- ../data/tzu\n" +
+		"***************\n" +
+		"*** 1,5 ****\n" +
+		"-      The Way that can be told of is not the eternal Way;\n" +
+		"-      The name that can be named is not the eternal name.\n" +
+		"       The Nameless is the origin of Heaven and Earth;\n" +
+		"!      The Named is the mother of all things.\n" +
+		"       Therefore let there always be non-being,\n" +
+		"--- 1,4 ----\n" +
+		"       The Nameless is the origin of Heaven and Earth;\n" +
+		"!      The named is the mother of all things.\n" +
+		"!      \n" +
+		"       Therefore let there always be non-being,\n" +
+		"***************\n" +
+		"*** 11 ****\n" +
+		"--- 10,13 ----\n" +
+		"         they have different names.\n" +
+		"+      They both may be called deep and profound.\n" +
+		"+      Deeper and more profound,\n" +
+		"+      The door of all subtleties!\n"
+	if s := FormatContextDiffToString(lao, tzu, pairs, 1); s != expected {
+		t.Errorf("Unexpected context diff:\n%s\nExpected:\n%s", s, expected)
+	}
+}
+
+func TestFormatEdScriptAndRCSDiff(t *testing.T) {
+	lao, tzu, pairs := performTestDiff2(t, "lao", "tzu")
+	var buf bytes.Buffer
+	FormatEdScript(lao, tzu, pairs, &buf)
+	expected := "11a\n" +
+		"     They both may be called deep and profound.\n" +
+		"     Deeper and more profound,\n" +
+		"     The door of all subtleties!\n" +
+		".\n" +
+		"4c\n" +
+		"     The named is the mother of all things.\n" +
+		"     \n" +
+		".\n" +
+		"1,2d\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected ed script:\n%s\nExpected:\n%s", buf.String(), expected)
+	}
+	buf.Reset()
+	FormatRCSDiff(lao, tzu, pairs, &buf)
+	expected = "d1 2\n" +
+		"d4 1\n" +
+		"a4 2\n" +
+		"     The named is the mother of all things.\n" +
+		"     \n" +
+		"a11 3\n" +
+		"     They both may be called deep and profound.\n" +
+		"     Deeper and more profound,\n" +
+		"     The door of all subtleties!\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected RCS diff:\n%s\nExpected:\n%s", buf.String(), expected)
+	}
+}
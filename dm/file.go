@@ -17,6 +17,7 @@ import (
 
 type File struct {
 	Name  string    // Command line arg
+	Label string    // Optional name for display, in place of Name.
 	Body  []byte    // Body of the file
 	Lines []LinePos // Locations and hashes of the file lines.
 
@@ -29,6 +30,15 @@ func (p *File) BriefDebugString() string {
 		path.Base(p.Name), len(p.Lines), len(p.Body))
 }
 
+// Returns the name to use when identifying the file in output (e.g. in
+// conflict markers and diff headers).
+func (p *File) DisplayName() string {
+	if p.Label != "" {
+		return p.Label
+	}
+	return p.Name
+}
+
 func (p *File) GetFullRange() FileRange {
 	return p.FullRange
 }
@@ -151,6 +161,11 @@ func ReadFile(name string) (*File, error) {
 		return nil, err
 	}
 	glog.Infof("Loaded %d bytes from file %s", len(body), name)
+	return BuildFile(name, body)
+}
+
+// Creates a File from a name and body, such as the result of merging files.
+func BuildFile(name string, body []byte) (*File, error) {
 	p := &File{
 		Name: name,
 		Body: body,
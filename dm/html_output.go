@@ -0,0 +1,367 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+// Formats a two-way diff (from the BlockPairs produced by PerformDiff2), a
+// three-way diff (from the Diff3Triples produced by PerformDiff3), or the
+// comparison of two directory trees (from CompareDirectories), as a single
+// self-contained HTML document (i.e. with inline styles and script), suitable
+// for sharing with code reviewers.
+//
+// The files are shown in aligned columns, as for FormatSideBySide, with the
+// kind of each block indicated by its color. Moved blocks are linked to the
+// place in A from which they were moved, and runs of unchanged lines longer
+// than 2*SideBySideConfig.ContextLines are collapsed, with a button to expand
+// them.
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table.diff { border-collapse: collapse; font-family: monospace; width: 100%%; }
+table.diff th { background: #eee; text-align: left; padding: 2px 4px; }
+table.diff td { padding: 0 4px; vertical-align: top; }
+table.diff td.text { white-space: %s; tab-size: %d; -moz-tab-size: %d; width: %d%%; }
+table.diff td.lineno { color: #888; text-align: right; user-select: none; }
+table.diff td.code { color: #888; text-align: center; user-select: none; }
+tr.normalized td.text { background: #fff8c4; }
+tr.mismatch td.text { background: #ffe0a0; }
+tr.delete td.a { background: #ffd0d0; }
+tr.insert td.b { background: #d0ffd0; }
+tr.move td.text { background: #d8e0ff; }
+tr.moved-away td { background: #eef; font-style: italic; }
+p.move { background: #d8e0ff; font-style: italic; }
+p.moved-away { background: #eef; font-style: italic; }
+tr.yours td.yours, tr.theirs td.theirs { background: #d0ffd0; }
+tr.both-same td.yours, tr.both-same td.theirs { background: #d8f0d8; }
+tr.conflict td.text { background: #ffd0d0; }
+tr.expander td { background: #f4f4f4; text-align: center; }
+tr:target td { outline: 2px solid #36c; }
+</style>
+<script>
+function expand(id, button) {
+  document.getElementById(id).hidden = false;
+  button.parentNode.parentNode.hidden = true;
+}
+</script>
+</head>
+<body>
+`
+
+const htmlFooter = `</body>
+</html>
+`
+
+// Accumulates the first error encountered while writing, so that callers
+// needn't check the result of every write.
+type htmlState struct {
+	cfg      SideBySideConfig
+	w        io.Writer
+	err      error
+	numFolds int
+
+	// Prepended to the ids of move anchors, so that they are unique when the
+	// document has several tables.
+	idPrefix string
+}
+
+func (state *htmlState) printf(format string, a ...interface{}) {
+	if state.err == nil {
+		_, state.err = fmt.Fprintf(state.w, format, a...)
+	}
+}
+
+func (state *htmlState) writeHeader(title string, numFiles int) {
+	whiteSpace := "pre"
+	if state.cfg.WrapLongLines {
+		whiteSpace = "pre-wrap"
+	}
+	tabSize := state.cfg.SpacesPerTab
+	if tabSize <= 0 {
+		tabSize = 8
+	}
+	state.printf(htmlHeader, html.EscapeString(title), whiteSpace, tabSize, tabSize,
+		90/numFiles)
+	state.printf("<h1>%s</h1>\n", html.EscapeString(title))
+}
+
+func (state *htmlState) writeFooter() {
+	state.printf("%s", htmlFooter)
+}
+
+// Returns the line number to display for the line with (zero-based) index.
+func (state *htmlState) lineNumber(index int) int {
+	if state.cfg.ZeroBasedLineNumbers {
+		return index
+	}
+	return index + 1
+}
+
+// Returns the escaped text of the line, without its line terminator.
+func htmlLineText(f *File, index int) string {
+	line := bytes.TrimRight(f.GetLineBytes(index), "\r\n")
+	return html.EscapeString(strings.ToValidUTF8(string(line), "�"))
+}
+
+// Writes the line number and text cells for one line of f, or empty cells if
+// index is beyond limit.
+func (state *htmlState) writeLineCells(f *File, index, limit int, class string) {
+	if index < limit {
+		state.printf("<td class=\"lineno\">%d</td><td class=\"text %s\">%s</td>",
+			state.lineNumber(index), class, htmlLineText(f, index))
+	} else {
+		state.printf("<td class=\"lineno\"></td><td class=\"text %s\"></td>", class)
+	}
+}
+
+// Starts a group of rows which is hidden until the user clicks the button
+// (in the preceding row) to show the numLines unchanged lines in the group.
+// The enclosing tbody is closed first, as tbody elements can't be nested.
+func (state *htmlState) startFold(numLines, numColumns int) {
+	state.numFolds++
+	id := fmt.Sprintf("fold-%d", state.numFolds)
+	state.printf("</tbody>\n<tbody><tr class=\"expander\"><td colspan=\"%d\">"+
+		"<button onclick=\"expand('%s', this)\">Show %d unchanged lines</button>"+
+		"</td></tr></tbody>\n<tbody id=\"%s\" hidden>\n", numColumns, id, numLines, id)
+}
+
+func (state *htmlState) endFold() {
+	state.printf("</tbody>\n<tbody>\n")
+}
+
+// Calls writeRow for each of the numLines rows of an unchanged block, hiding
+// those which aren't within ContextLines of a change.
+func (state *htmlState) writeUnchangedRows(numLines, numColumns int, writeRow func(i int)) {
+	contextLines := state.cfg.ContextLines
+	if contextLines <= 0 || numLines <= 2*contextLines {
+		for i := 0; i < numLines; i++ {
+			writeRow(i)
+		}
+		return
+	}
+	for i := 0; i < contextLines; i++ {
+		writeRow(i)
+	}
+	state.startFold(numLines-2*contextLines, numColumns)
+	for i := contextLines; i < numLines-contextLines; i++ {
+		writeRow(i)
+	}
+	state.endFold()
+	for i := numLines - contextLines; i < numLines; i++ {
+		writeRow(i)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Two-way diffs.
+
+// Returns the CSS class for the rows of the pair.
+func htmlClassForBlockPair(pair *BlockPair, moved bool) string {
+	if moved {
+		return "move"
+	} else if pair.IsMatch {
+		return "match"
+	} else if pair.IsNormalizedMatch {
+		return "normalized"
+	} else if pair.ALength == 0 {
+		return "insert"
+	} else if pair.BLength == 0 {
+		return "delete"
+	}
+	return "mismatch"
+}
+
+// Writes the two-way diff as an HTML document, with the lines of B in order,
+// and those of A aligned with them.
+func FormatHTMLSideBySide(aFile, bFile *File, pairs BlockPairs, w io.Writer,
+	config SideBySideConfig) error {
+	state := &htmlState{cfg: config, w: w}
+	state.writeHeader(fmt.Sprintf("%s vs. %s", aFile.DisplayName(), bFile.DisplayName()), 2)
+	state.writeSideBySideTable(aFile, bFile, pairs)
+	state.writeFooter()
+	return state.err
+}
+
+func (state *htmlState) writeSideBySideTable(aFile, bFile *File, pairs BlockPairs) {
+	pairs = append(BlockPairs(nil), pairs...)
+	SortBlockPairsByBIndex(pairs)
+
+	moves := findDisplayedMoves(pairs, false)
+	// Anchors are named for the index of the first pair of the move.
+	firstPairIndex := make(map[*displayedMove]int)
+	for n := len(pairs) - 1; n >= 0; n-- {
+		if move := moves.moveOfPair[pairs[n]]; move != nil {
+			firstPairIndex[move] = n
+		}
+	}
+
+	state.printf("<table class=\"diff\">\n<thead><tr><th></th><th>%s</th><th></th><th>%s</th><th></th></tr></thead>\n<tbody>\n",
+		html.EscapeString(aFile.DisplayName()), html.EscapeString(bFile.DisplayName()))
+	writeMovedAway := func(n int) {
+		for _, move := range moves.movedAwayBefore[n] {
+			state.printf("<tr class=\"moved-away\" id=\"%smove-%d-from\"><td></td>"+
+				"<td colspan=\"4\">Lines %d-%d of %s were moved to "+
+				"<a href=\"#%smove-%d-to\">line %d of %s</a> (move %d)</td></tr>\n",
+				state.idPrefix, firstPairIndex[move], state.lineNumber(move.aStart),
+				state.lineNumber(move.aBeyond-1), html.EscapeString(aFile.DisplayName()),
+				state.idPrefix, firstPairIndex[move],
+				state.lineNumber(move.bStart), html.EscapeString(bFile.DisplayName()), move.id)
+		}
+	}
+	for n, pair := range pairs {
+		writeMovedAway(n)
+		move := moves.moveOfPair[pair]
+		moved := move != nil
+		isFirstOfMove := moved && firstPairIndex[move] == n
+		class := htmlClassForBlockPair(pair, moved)
+		var sxs sideBySideState
+		code := string([]byte{sxs.getCodeForBlockPair(pair)})
+		writeRow := func(i int) {
+			if isFirstOfMove && i == 0 {
+				state.printf("<tr class=\"%s\" id=\"%smove-%d-to\">", class, state.idPrefix, n)
+			} else {
+				state.printf("<tr class=\"%s\">", class)
+			}
+			state.writeLineCells(aFile, pair.AIndex+i, pair.ABeyond(), "a")
+			if isFirstOfMove && i == 0 {
+				state.printf("<td class=\"code\"><a href=\"#%smove-%d-from\" title=\"move %d\">%s</a></td>",
+					state.idPrefix, n, move.id, code)
+			} else {
+				state.printf("<td class=\"code\">%s</td>", code)
+			}
+			if i < pair.BLength {
+				state.printf("<td class=\"text b\">%s</td><td class=\"lineno\">%d</td>",
+					htmlLineText(bFile, pair.BIndex+i), state.lineNumber(pair.BIndex+i))
+			} else {
+				state.printf("<td class=\"text b\"></td><td class=\"lineno\"></td>")
+			}
+			state.printf("</tr>\n")
+		}
+		numLines := MaxInt(pair.ALength, pair.BLength)
+		if pair.IsMatch && !moved {
+			state.writeUnchangedRows(numLines, 5, writeRow)
+		} else {
+			for i := 0; i < numLines; i++ {
+				writeRow(i)
+			}
+		}
+	}
+	writeMovedAway(len(pairs))
+	state.printf("</tbody>\n</table>\n")
+}
+
+func FormatHTMLSideBySideToString(aFile, bFile *File, pairs BlockPairs,
+	config SideBySideConfig) string {
+	var buf bytes.Buffer
+	FormatHTMLSideBySide(aFile, bFile, pairs, &buf, config)
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Three-way diffs.
+
+// Returns the CSS class for the rows of the triple.
+func htmlClassForDiff3Triple(triple *Diff3Triple) string {
+	switch triple.TripleType {
+	case YoursChangedTriple:
+		return "yours"
+	case TheirsChangedTriple:
+		return "theirs"
+	case BothSameTriple:
+		return "both-same"
+	case ConflictTriple:
+		return "conflict"
+	}
+	return "match"
+}
+
+// Writes the three-way diff as an HTML document, with yours, base and theirs
+// in adjacent columns.
+func FormatHTMLDiff3(yours, base, theirs *File, triples Diff3Triples,
+	w io.Writer, config SideBySideConfig) error {
+	state := &htmlState{cfg: config, w: w}
+	state.writeHeader(fmt.Sprintf("%s, %s and %s", yours.DisplayName(),
+		base.DisplayName(), theirs.DisplayName()), 3)
+	state.printf("<table class=\"diff\">\n<thead><tr><th></th><th>%s</th><th></th><th>%s</th><th></th><th>%s</th></tr></thead>\n<tbody>\n",
+		html.EscapeString(yours.DisplayName()), html.EscapeString(base.DisplayName()),
+		html.EscapeString(theirs.DisplayName()))
+	for _, triple := range triples {
+		class := htmlClassForDiff3Triple(triple)
+		yStart, yBeyond := triple.YoursRange()
+		tStart, tBeyond := triple.TheirsRange()
+		writeRow := func(i int) {
+			state.printf("<tr class=\"%s\">", class)
+			state.writeLineCells(yours, yStart+i, yBeyond, "yours")
+			state.writeLineCells(base, triple.BaseStart+i, triple.BaseBeyond, "base")
+			state.writeLineCells(theirs, tStart+i, tBeyond, "theirs")
+			state.printf("</tr>\n")
+		}
+		numLines := MaxInt(triple.BaseBeyond-triple.BaseStart, MaxInt(yBeyond-yStart, tBeyond-tStart))
+		if triple.TripleType == UnchangedTriple {
+			state.writeUnchangedRows(numLines, 6, writeRow)
+		} else {
+			for i := 0; i < numLines; i++ {
+				writeRow(i)
+			}
+		}
+	}
+	state.printf("</tbody>\n</table>\n")
+	state.writeFooter()
+	return state.err
+}
+
+func FormatHTMLDiff3ToString(yours, base, theirs *File, triples Diff3Triples,
+	config SideBySideConfig) string {
+	var buf bytes.Buffer
+	FormatHTMLDiff3(yours, base, theirs, triples, &buf, config)
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Directory diffs.
+
+// Writes the comparison of two directory trees as an HTML document, with a
+// section for each file which differs or is only in one of the trees.
+func FormatHTMLDirDiff(dirDiff *DirDiff, w io.Writer, config SideBySideConfig) error {
+	state := &htmlState{cfg: config, w: w}
+	state.writeHeader(fmt.Sprintf("%s vs. %s", dirDiff.ADir, dirDiff.BDir), 2)
+	for n, entry := range dirDiff.Entries {
+		path := html.EscapeString(entry.Path)
+		switch entry.Status {
+		case FilesDiffer, FileRenamed:
+			if entry.Status == FileRenamed {
+				state.printf("<h2 id=\"file-%d\">%s (renamed from %s)</h2>\n", n+1, path,
+					html.EscapeString(entry.OldPath))
+			} else {
+				state.printf("<h2 id=\"file-%d\">%s</h2>\n", n+1, path)
+			}
+			state.idPrefix = fmt.Sprintf("file-%d-", n+1)
+			state.writeSideBySideTable(entry.AFile, entry.BFile, entry.Pairs)
+		case BinaryFilesDiffer:
+			state.printf("<h2 id=\"file-%d\">%s</h2>\n<p>Binary files differ.</p>\n", n+1, path)
+		case OnlyInA:
+			state.printf("<h2 id=\"file-%d\">%s</h2>\n<p>Only in %s.</p>\n", n+1, path,
+				html.EscapeString(dirDiff.ADir))
+		case OnlyInB:
+			state.printf("<h2 id=\"file-%d\">%s</h2>\n<p>Only in %s.</p>\n", n+1, path,
+				html.EscapeString(dirDiff.BDir))
+		}
+		for _, move := range dirDiff.MovesFrom(entry) {
+			state.printf("<p class=\"moved-away\">%s</p>\n", html.EscapeString(move.MovedToString()))
+		}
+		for _, move := range dirDiff.MovesTo(entry) {
+			state.printf("<p class=\"move\">%s</p>\n", html.EscapeString(move.MovedFromString()))
+		}
+	}
+	state.writeFooter()
+	return state.err
+}
@@ -0,0 +1,69 @@
+package dm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatHTMLSideBySide(t *testing.T) {
+	aFile, bFile, pairs := performTestDiff2(t, "swap_1234", "swap_1324")
+	cfg := DefaultSideBySideConfig
+	cfg.ContextLines = 1
+	s := FormatHTMLSideBySideToString(aFile, bFile, pairs, cfg)
+	for _, expected := range []string{
+		"<!DOCTYPE html>",
+		`<tr class="move" id="move-`,
+		`<tr class="moved-away" id="move-`,
+		`Lines 9-12 of ../data/swap_1234 were moved to`,
+		`<button onclick="expand('fold-1', this)">`,
+		"</tbody>\n<tbody><tr class=\"expander\">",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("HTML output is missing %q:\n%s", expected, s)
+		}
+	}
+}
+
+func TestFormatHTMLDiff3(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	s := FormatHTMLDiff3ToString(yours, base, theirs, triples, DefaultSideBySideConfig)
+	if !strings.Contains(s, `<tr class="conflict">`) {
+		t.Errorf("HTML output has no conflict:\n%s", s)
+	}
+}
+
+func TestFormatHTMLSideBySideEscapesLines(t *testing.T) {
+	aFile, _ := BuildFile("a", []byte("if (a < b) {\n"))
+	bFile, _ := BuildFile("b", []byte("if (a <= b && c) {\n"))
+	pairs := BlockPairs{{AIndex: 0, ALength: 1, BIndex: 0, BLength: 1}}
+	s := FormatHTMLSideBySideToString(aFile, bFile, pairs, DefaultSideBySideConfig)
+	if !strings.Contains(s, `<td class="text a">if (a &lt; b) {</td>`) ||
+		!strings.Contains(s, `<td class="text b">if (a &lt;= b &amp;&amp; c) {</td>`) {
+		t.Errorf("HTML output isn't escaped:\n%s", s)
+	}
+}
+
+// Blocks moved to another file are shown with the file they were moved from
+// as moved away, and with the file they were moved to as a move.
+func TestFormatHTMLDirDiffMoves(t *testing.T) {
+	body := "func beta() {\n\ta := compute(7)\n\tb := transform(a)\n\treturn b\n}\n"
+	aDir := writeTestTree(t, map[string]string{"big.go": "package big\n\n" + body})
+	bDir := writeTestTree(t, map[string]string{"big.go": "package big\n", "split.go": "package big\n\n" + body})
+	dirDiff, err := CompareDirectories(aDir, bDir, DefaultDifferencerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := FormatHTMLDirDiff(dirDiff, &buf, DefaultSideBySideConfig); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	for _, expected := range []string{
+		`<p class="moved-away">Lines 2-7 moved to split.go:2 (move 1)</p>`,
+		`<p class="move">Lines 2-7 moved from big.go:2 (move 1)</p>`,
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("HTML output is missing %q:\n%s", expected, s)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Converts a unified diff produced by another tool (parsed by
+// ParseUnifiedDiff) back into the pair of files and the BlockPairs that
+// describe it, so that it can be displayed by any of the formatters (e.g.
+// FormatSideBySide). Tools such as diff(1) report a moved block as a deletion
+// and an insertion; optionally, the moves can be found by running the move
+// detection phase of PerformDiff2 on the gaps between the matched lines.
+
+// Returns the new file produced by applying the patch to the original file,
+// and the matched blocks implied by the patch (the context lines of the
+// hunks and the lines between hunks). Unlike ApplyPatch, the hunks must
+// apply exactly at the lines given in their headers.
+func reconstructPatchedFile(original *File, patch *FilePatch) (
+	body []byte, matches BlockPairs, err error) {
+	var buf bytes.Buffer
+	addMatch := func(aIndex, bIndex, length int) {
+		if length <= 0 {
+			return
+		}
+		if n := len(matches); n > 0 {
+			last := matches[n-1]
+			if last.ABeyond() == aIndex && last.BBeyond() == bIndex {
+				last.ALength += length
+				last.BLength += length
+				return
+			}
+		}
+		matches = append(matches, &BlockPair{
+			AIndex: aIndex, ALength: length, BIndex: bIndex, BLength: length, IsMatch: true,
+		})
+	}
+	aIndex, bIndex := 0, 0
+	copyLines := func(beyond int) {
+		addMatch(aIndex, bIndex, beyond-aIndex)
+		for ; aIndex < beyond; aIndex++ {
+			buf.Write(original.GetLineBytes(aIndex))
+			bIndex++
+		}
+	}
+	for n, hunk := range patch.Hunks {
+		if hunk.OldStart < aIndex || hunk.OldStart+hunk.OldLength > original.LineCount() {
+			return nil, nil, fmt.Errorf("hunk #%d (%s) is outside of %s, or out of order",
+				n+1, hunk.Header(), original.DisplayName())
+		}
+		copyLines(hunk.OldStart)
+		for _, line := range hunk.Lines {
+			if line.Op != '+' && !bytes.Equal(line.Text, original.GetLineBytes(aIndex)) {
+				return nil, nil, fmt.Errorf("hunk #%d (%s) doesn't match line %d of %s",
+					n+1, hunk.Header(), aIndex+1, original.DisplayName())
+			}
+			switch line.Op {
+			case ' ':
+				addMatch(aIndex, bIndex, 1)
+				aIndex++
+				bIndex++
+			case '-':
+				aIndex++
+			case '+':
+				bIndex++
+			}
+			if line.Op != '-' {
+				buf.Write(line.Text)
+			}
+		}
+	}
+	copyLines(original.LineCount())
+	return buf.Bytes(), matches, nil
+}
+
+// Returns the files before and after the patch was applied to original, and
+// the BlockPairs (as produced by PerformDiff2) for the changes made by the
+// patch. If config.DetectBlockMoves is true, blocks which the patch deletes
+// and inserts elsewhere are matched as moves.
+func ImportUnifiedDiff(original *File, patch *FilePatch, config DifferencerConfig) (
+	aFile, bFile *File, pairs BlockPairs, err error) {
+	defer glog.Flush()
+	body, matches, err := reconstructPatchedFile(original, patch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	name := patch.NewName
+	if name == "" || name == "/dev/null" {
+		name = original.Name
+	}
+	bFile, err = BuildFile(name, body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aFile = original
+	if aFile.LineCount() == 0 || bFile.LineCount() == 0 {
+		return aFile, bFile, PerformDiff2(aFile, bFile, config), nil
+	}
+	filePair := MakeFilePair(aFile, bFile)
+	if config.DetectBlockMoves {
+		numMatchedLines, _ := matches.CountLinesInPairs()
+		matches = PerformMoveDetectionInGaps(filePair.FullFileRangePair(), matches,
+			config, diff2SimilarityFactors(config))
+		newNumMatchedLines, _ := matches.CountLinesInPairs()
+		glog.Infof("Found %d moved or copied lines", newNumMatchedLines-numMatchedLines)
+		matches = ExtendMatchesForward(filePair, matches)
+		matches = ExtendMatchesBackward(filePair, matches)
+	}
+	SortBlockPairsByBIndex(matches)
+	matches = CombineBlockPairs(matches)
+	pairs = fillUnpairedLines(filePair, FillRemainingBGapsWithMismatches(filePair, matches))
+	return aFile, bFile, SplitIndentationChanges(aFile, bFile, pairs), nil
+}
+
+// Adds the pairs that FillRemainingBGapsWithMismatches doesn't create: for
+// the lines at the end of B after the last pair, and for any lines of A which
+// aren't in a pair (i.e. which were deleted, and not replaced). Returns the
+// pairs sorted by BIndex.
+func fillUnpairedLines(filePair FilePair, pairs BlockPairs) BlockPairs {
+	SortBlockPairsByBIndex(pairs)
+	bBeyond, aBeyond := 0, 0
+	if n := len(pairs); n > 0 {
+		bBeyond, aBeyond = pairs[n-1].BBeyond(), pairs[n-1].ABeyond()
+	}
+	if bBeyond < filePair.BLength() {
+		pairs = append(pairs, &BlockPair{
+			AIndex:  aBeyond,
+			BIndex:  bBeyond,
+			BLength: filePair.BLength() - bBeyond,
+		})
+	}
+	pairedALines := AIndexBlockPairsToIntervalSet(pairs, SelectAllBlockPairs)
+	// The location in B of the end of each pair in A, so that the deleted lines
+	// are placed after the lines that precede them in A.
+	bIndexAfterA := map[int]int{0: 0}
+	for _, pair := range pairs {
+		bIndexAfterA[pair.ABeyond()] = pair.BBeyond()
+	}
+	for aIndex := 0; aIndex < filePair.ALength(); {
+		if pairedALines.Contains(aIndex) {
+			aIndex++
+			continue
+		}
+		aStart := aIndex
+		for aIndex < filePair.ALength() && !pairedALines.Contains(aIndex) {
+			aIndex++
+		}
+		pairs = append(pairs, &BlockPair{
+			AIndex:  aStart,
+			ALength: aIndex - aStart,
+			BIndex:  bIndexAfterA[aStart],
+		})
+	}
+	SortBlockPairsByBIndex(pairs)
+	return pairs
+}
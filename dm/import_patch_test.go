@@ -0,0 +1,76 @@
+package dm
+
+import (
+	"testing"
+)
+
+// func2 moved after func3, as diff(1) would report it.
+const swapPatch = "--- a/swap_1234\n" +
+	"+++ b/swap_1324\n" +
+	"@@ -2,11 +2,11 @@\n" +
+	"   x += 1\n" +
+	" }\n" +
+	" \n" +
+	"-void func2() {\n" +
+	"-  x += 2\n" +
+	"-}\n" +
+	"-\n" +
+	" void func3() {\n" +
+	"   y += 3\n" +
+	" }\n" +
+	" \n" +
+	"+void func2() {\n" +
+	"+  x += 2\n" +
+	"+}\n" +
+	"+\n"
+
+func TestImportUnifiedDiff(t *testing.T) {
+	patches, err := ParseUnifiedDiffString(swapPatch)
+	if err != nil {
+		t.Fatalf("Failed to parse unified diff: %s", err)
+	}
+	original := readTestFile(t, "swap_1234")
+	cfg := DefaultDifferencerConfig()
+
+	cfg.DetectBlockMoves = false
+	aFile, bFile, pairs, err := ImportUnifiedDiff(original, patches[0], cfg)
+	if err != nil {
+		t.Fatalf("Failed to import unified diff: %s", err)
+	}
+	if expected := readTestFile(t, "swap_1324"); string(bFile.Body) != string(expected.Body) {
+		t.Errorf("Unexpected patched file:\n%s", bFile.Body)
+	}
+	var numDeleted, numInserted int
+	for _, pair := range pairs {
+		if !pair.IsMatch {
+			numDeleted += pair.ALength
+			numInserted += pair.BLength
+		}
+	}
+	if aFile != original || len(pairs) != 5 || numDeleted != 4 || numInserted != 4 {
+		t.Errorf("Expected a deletion and an insertion, not:\n%s",
+			FormatSideBySideToString(aFile, bFile, pairs, false, DefaultSideBySideConfig))
+	}
+
+	cfg.DetectBlockMoves = true
+	aFile, bFile, pairs, err = ImportUnifiedDiff(original, patches[0], cfg)
+	if err != nil {
+		t.Fatalf("Failed to import unified diff: %s", err)
+	}
+	var moved *BlockPair
+	for _, pair := range pairs {
+		if !(pair.IsMatch || pair.IsNormalizedMatch) {
+			t.Errorf("Unexpected unmatched pair: %v", pair)
+		} else if pair.AIndex == 4 {
+			moved = pair
+		}
+	}
+	if moved == nil || moved.BIndex != 8 {
+		t.Errorf("Expected func2 to be matched as a move, not:\n%s",
+			FormatSideBySideToString(aFile, bFile, pairs, false, DefaultSideBySideConfig))
+	}
+
+	if _, _, _, err := ImportUnifiedDiff(bFile, patches[0], cfg); err == nil {
+		t.Errorf("Expected an error importing the patch against the wrong file")
+	}
+}
@@ -1,23 +1,24 @@
 package dm
 
-import ()
-
-// TODO Implement code for detecting indentation changes. Specifically:
-// 1) Given a BlockPair.NormalizedMatch with several lines, determine if all
-//    lines have the same change to their indentation (probably won't work
-//    well for files that use both spaces and tabs for indentation). The change
-//    might be the addition or removal of the same leading string of whitespace (could
-//    also check for a change from tab indentation to space indentation, or
-//    vice versa).
-// 2) Given such a change, see if the adjacent (in AIndex & BIndex terms)
-//    non-match lines have the same leading string; if so extend the range of
-//    the detected indentation change, and continue to ask the same question
-//    of the next or previous NormalizedMatch; lather, rinse, repeat until
-//    we have a contiguous sequence of lines with the same change to their
-//    indentation (could also look for a minimum indentation change, with
-//    the possibility that there might be other indentation changes nested
-//    inside the first).
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Detection of indentation changes (README problem #6): given a BlockPair
+// whose lines match after normalization, determine which runs of lines differ
+// only by the same change to their indentation (e.g. the addition of a tab to
+// the start of each line, as when a block is wrapped in an if statement), and
+// split the pair into BlockPairs for those runs, with the change recorded in
+// BlockPair.IndentationChange, and BlockPairs for the remaining lines.
+// Whitespace-only lines are included in a run if they are within it.
 //
+// TODO Look for nested indentation changes (i.e. a minimum change for a long
+// run, with a further change for some of its lines), and for changes from
+// tab indentation to space indentation (or vice versa).
 //
 // Alternate/supporting idea: add a new field, LinePos.IndentationDepth
 // which estimates the amount of indentation the line starts with (I say
@@ -154,5 +155,158 @@ func MeasureLeadingWhitespace(files ...*File) (stats LeadingWhitespaceStatistics
 	return
 }
 
+// A uniform change to the indentation of a run of lines: the A line's
+// indentation ends with Removed, which is replaced by Added in the B line.
+type IndentationChange struct {
+	Removed, Added string
+}
+
+func describeWhitespace(sign string, ws string) string {
+	var parts []string
+	if n := strings.Count(ws, "\t"); n == 1 {
+		parts = append(parts, sign+"1 tab")
+	} else if n > 1 {
+		parts = append(parts, fmt.Sprintf("%s%d tabs", sign, n))
+	}
+	if n := strings.Count(ws, " "); n == 1 {
+		parts = append(parts, sign+"1 space")
+	} else if n > 1 {
+		parts = append(parts, fmt.Sprintf("%s%d spaces", sign, n))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Describes the change, e.g. "+1 tab" or "-2 spaces +1 tab".
+func (c IndentationChange) String() string {
+	removed, added := describeWhitespace("-", c.Removed), describeWhitespace("+", c.Added)
+	if removed != "" && added != "" {
+		return removed + " " + added
+	}
+	return removed + added
+}
+
+// Returns the change to the indentation of aLine which produces bLine, if
+// the lines differ only in their indentation.
+func ComputeIndentationChange(aLine, bLine []byte) (change IndentationChange, ok bool) {
+	aText, bText := removeIndent(aLine), removeIndent(bLine)
+	if !bytes.Equal(aText, bText) {
+		return
+	}
+	aIndent := aLine[:len(aLine)-len(aText)]
+	bIndent := bLine[:len(bLine)-len(bText)]
+	shared := 0
+	for shared < len(aIndent) && shared < len(bIndent) && aIndent[shared] == bIndent[shared] {
+		shared++
+	}
+	change.Removed = string(aIndent[shared:])
+	change.Added = string(bIndent[shared:])
+	return change, true
+}
+
+// Applies the change to the indentation of the line, returning the modified
+// line, if the line's indentation ends with c.Removed. Whitespace-only lines
+// are returned unmodified.
+func (c IndentationChange) Apply(line []byte) ([]byte, bool) {
+	text := removeIndent(line)
+	if len(bytes.TrimSpace(text)) == 0 {
+		return line, true
+	}
+	indent := line[:len(line)-len(text)]
+	if !bytes.HasSuffix(indent, []byte(c.Removed)) {
+		return nil, false
+	}
+	var result []byte
+	result = append(result, indent[:len(indent)-len(c.Removed)]...)
+	result = append(result, c.Added...)
+	return append(result, text...), true
+}
+
+func isWhitespaceLine(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// Splits the normalized matches among the pairs into exact matches, runs of
+// lines with the same indentation change, and the remaining normalized
+// matches; other pairs are returned as is.
+func SplitIndentationChanges(aFile, bFile *File, pairs BlockPairs) (result BlockPairs) {
+	for _, pair := range pairs {
+		if !pair.IsNormalizedMatch || pair.ALength != pair.BLength {
+			result = append(result, pair)
+			continue
+		}
+		var current *BlockPair
+		add := func(n int, isMatch bool, change *IndentationChange) {
+			if current != nil && current.IsMatch == isMatch &&
+				indentationChangesAreEqual(current.IndentationChange, change) {
+				current.ALength++
+				current.BLength++
+				return
+			}
+			current = &BlockPair{
+				AIndex:            pair.AIndex + n,
+				ALength:           1,
+				BIndex:            pair.BIndex + n,
+				BLength:           1,
+				IsMatch:           isMatch,
+				IsNormalizedMatch: !isMatch,
+				IsMove:            pair.IsMove,
+				MoveId:            pair.MoveId,
+				IndentationChange: change,
+			}
+			result = append(result, current)
+		}
+		for n := 0; n < pair.ALength; n++ {
+			aLine := aFile.GetLineBytes(pair.AIndex + n)
+			bLine := bFile.GetLineBytes(pair.BIndex + n)
+			if bytes.Equal(aLine, bLine) {
+				// Keep whitespace-only lines in a run of indentation changes if the
+				// run continues after them.
+				if current != nil && current.IndentationChange != nil && isWhitespaceLine(aLine) &&
+					continuesIndentationChange(aFile, bFile, pair, n+1, current.IndentationChange) {
+					add(n, false, current.IndentationChange)
+				} else {
+					add(n, true, nil)
+				}
+			} else if change, ok := ComputeIndentationChange(aLine, bLine); ok {
+				add(n, false, &change)
+			} else {
+				add(n, false, nil)
+			}
+		}
+	}
+	if glog.V(1) {
+		for _, pair := range result {
+			if pair.IndentationChange != nil {
+				glog.Infof("SplitIndentationChanges: %v has indentation change %v",
+					*pair, *pair.IndentationChange)
+			}
+		}
+	}
+	return
+}
+
+// Is the first line after the whitespace-only lines starting at offset n of
+// the pair a line with the indentation change?
+func continuesIndentationChange(aFile, bFile *File, pair *BlockPair, n int,
+	change *IndentationChange) bool {
+	for ; n < pair.ALength; n++ {
+		aLine := aFile.GetLineBytes(pair.AIndex + n)
+		bLine := bFile.GetLineBytes(pair.BIndex + n)
+		if bytes.Equal(aLine, bLine) && isWhitespaceLine(aLine) {
+			continue
+		}
+		c, ok := ComputeIndentationChange(aLine, bLine)
+		return ok && c == *change
+	}
+	return false
+}
+
+func indentationChangesAreEqual(c, d *IndentationChange) bool {
+	if c == nil || d == nil {
+		return c == d
+	}
+	return *c == *d
+}
+
 //func GuessTabSpaces(
 // TODO measure how many spaces are in front of lines, figure out the peaks (e.g. 2 much more than 1, or 4 much more than 2).
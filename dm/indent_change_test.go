@@ -0,0 +1,41 @@
+package dm
+
+import (
+	"testing"
+)
+
+func TestIndentationChangeString(t *testing.T) {
+	for _, tc := range []struct {
+		change   IndentationChange
+		expected string
+	}{
+		{IndentationChange{Added: "\t"}, "+1 tab"},
+		{IndentationChange{Added: "    "}, "+4 spaces"},
+		{IndentationChange{Removed: "  "}, "-2 spaces"},
+		{IndentationChange{Removed: "\t", Added: "    "}, "-1 tab +4 spaces"},
+	} {
+		if s := tc.change.String(); s != tc.expected {
+			t.Errorf("%#v.String() = %q, expected %q", tc.change, s, tc.expected)
+		}
+	}
+}
+
+func TestPerformDiff2IndentationOnly(t *testing.T) {
+	aFile, _ := BuildFile("a", []byte("if (x) {\n  f();\n\n  g();\n}\n"))
+	bFile, _ := BuildFile("b", []byte("if (x) {\n\tf();\n\n\tg();\n}\n"))
+	cfg := DefaultDifferencerConfig()
+	pairs := PerformDiff2(aFile, bFile, cfg)
+	SortBlockPairsByAIndex(pairs)
+	if len(pairs) != 3 {
+		t.Fatalf("Expected 3 pairs, not %d", len(pairs))
+	}
+	expected := IndentationChange{Removed: "  ", Added: "\t"}
+	pair := pairs[1]
+	if pair.AIndex != 1 || pair.ALength != 3 || pair.IndentationChange == nil ||
+		*pair.IndentationChange != expected {
+		t.Errorf("Unexpected pair: %v %v", *pair, pair.IndentationChange)
+	}
+	if !pairs[0].IsMatch || !pairs[2].IsMatch {
+		t.Errorf("Expected the first and last lines to be exact matches")
+	}
+}
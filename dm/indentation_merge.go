@@ -0,0 +1,174 @@
+package dm
+
+import (
+	"bytes"
+
+	"github.com/golang/glog"
+)
+
+// Resolves conflicts where one side (the re-indenter) changed the indentation
+// of lines, perhaps also inserting lines (e.g. wrapping a block in an if
+// statement), while the other side (the editor) edited the content of some of
+// those lines. The edited lines are re-indented in the same way as the base
+// lines they replace, and the lines inserted by the re-indenter are kept.
+
+// Aligns the lines [aStart, aBeyond) of aFile with [bStart, bBeyond) of
+// bFile, returning for each line of A the index (relative to bStart) of the
+// line of B it is aligned with, or -1.
+func alignLines(aFile *File, aStart, aBeyond int, bFile *File, bStart, bBeyond int,
+	equal func(aLine, bLine []byte) bool) (alignment []int) {
+	alignment = make([]int, aBeyond-aStart)
+	for n := range alignment {
+		alignment[n] = -1
+	}
+	lcs, _ := WeightedLCS(aBeyond-aStart, bBeyond-bStart, func(aIndex, bIndex int) float32 {
+		if equal(aFile.GetLineBytes(aStart+aIndex), bFile.GetLineBytes(bStart+bIndex)) {
+			return 1
+		}
+		return 0
+	})
+	for _, ip := range lcs {
+		alignment[ip.Index1] = ip.Index2
+	}
+	return
+}
+
+func sameExceptIndentation(aLine, bLine []byte) bool {
+	return bytes.Equal(removeIndent(aLine), removeIndent(bLine))
+}
+
+// Attempts to resolve the conflict as a change to indentation by one side,
+// and edits by the other.
+func ResolveIndentationConflict(yours, base, theirs *File, triple *Diff3Triple) (
+	resolved [][]byte, ok bool) {
+	yStart, yBeyond := triple.YoursRange()
+	tStart, tBeyond := triple.TheirsRange()
+	resolved, ok = mergeIndentationChanges(
+		base, triple.BaseStart, triple.BaseBeyond, yours, yStart, yBeyond, theirs, tStart, tBeyond)
+	if !ok {
+		resolved, ok = mergeIndentationChanges(
+			base, triple.BaseStart, triple.BaseBeyond, theirs, tStart, tBeyond, yours, yStart, yBeyond)
+	}
+	if ok {
+		glog.Infof("ResolveIndentationConflict resolved base lines [%d, %d)",
+			triple.BaseStart, triple.BaseBeyond)
+	}
+	return
+}
+
+func mergeIndentationChanges(base *File, bStart, bBeyond int,
+	reindenter *File, rStart, rBeyond int, editor *File, eStart, eBeyond int) (
+	resolved [][]byte, ok bool) {
+	numBase := bBeyond - bStart
+	if numBase == 0 {
+		return nil, false
+	}
+	// Every base line must still be present in the re-indenter.
+	rAlign := alignLines(base, bStart, bBeyond, reindenter, rStart, rBeyond, sameExceptIndentation)
+	changes := make([]IndentationChange, numBase)
+	anyChanged := false
+	for i, r := range rAlign {
+		if r < 0 {
+			return nil, false
+		}
+		changes[i], _ = ComputeIndentationChange(
+			base.GetLineBytes(bStart+i), reindenter.GetLineBytes(rStart+r))
+		if changes[i] != (IndentationChange{}) {
+			anyChanged = true
+		}
+	}
+	if !anyChanged {
+		return nil, false
+	}
+	// If the editor also just changed indentation, the changes really do
+	// conflict.
+	if eBeyond-eStart == numBase {
+		eAlign := alignLines(base, bStart, bBeyond, editor, eStart, eBeyond, sameExceptIndentation)
+		allAligned := true
+		for _, e := range eAlign {
+			allAligned = allAligned && e >= 0
+		}
+		if allAligned {
+			return nil, false
+		}
+	}
+	eAlign := alignLines(base, bStart, bBeyond, editor, eStart, eBeyond, bytes.Equal)
+
+	// Returns the index in the re-indenter (relative to rStart) of the base
+	// line with index i (relative to bStart), with sentinels at both ends.
+	rIndex := func(i int) int {
+		if i < 0 {
+			return -1
+		} else if i >= numBase {
+			return rBeyond - rStart
+		}
+		return rAlign[i]
+	}
+	// Appends the lines inserted by the re-indenter before base line i.
+	addInsertions := func(i int) {
+		for r := rIndex(i-1) + 1; r < rIndex(i); r++ {
+			resolved = append(resolved, reindenter.GetLineBytes(rStart+r))
+		}
+	}
+	hasInsertions := func(i int) bool {
+		return rIndex(i)-rIndex(i-1) > 1
+	}
+
+	prevB, prevE := -1, -1
+	for i := 0; i <= numBase; i++ {
+		e := eBeyond - eStart
+		if i < numBase {
+			if eAlign[i] < 0 {
+				continue
+			}
+			e = eAlign[i]
+		}
+		// The editor replaced the base lines (prevB, i) with the lines (prevE, e).
+		if i-prevB > 1 || e-prevE > 1 {
+			var change *IndentationChange
+			for d := prevB + 1; d < i; d++ {
+				if change != nil && *change != changes[d] {
+					return nil, false
+				}
+				change = &changes[d]
+			}
+			if i-prevB == 1 {
+				// An insertion by the editor, which must not be at the same place as
+				// an insertion by the re-indenter.
+				if hasInsertions(i) {
+					return nil, false
+				}
+				for _, d := range []int{prevB, i} {
+					if 0 <= d && d < numBase {
+						if change != nil && *change != changes[d] {
+							return nil, false
+						}
+						change = &changes[d]
+					}
+				}
+			} else {
+				for d := prevB + 2; d < i; d++ {
+					if hasInsertions(d) {
+						return nil, false
+					}
+				}
+				addInsertions(prevB + 1)
+			}
+			for n := prevE + 1; n < e; n++ {
+				line := editor.GetLineBytes(eStart + n)
+				if change != nil {
+					if line, ok = change.Apply(line); !ok {
+						return nil, false
+					}
+				}
+				resolved = append(resolved, line)
+			}
+		}
+		addInsertions(i)
+		if i < numBase {
+			resolved = append(resolved, reindenter.GetLineBytes(rStart+rAlign[i]))
+		}
+		prevB, prevE = i, e
+	}
+	return resolved, true
+}
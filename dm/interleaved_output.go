@@ -1,14 +1,45 @@
 package dm
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 )
 
 func FormatInterleaved(pairs []*BlockPair, aIsPrimary bool, aFile, bFile *File,
 	w io.Writer, printLineNumbers bool) error {
+	return FormatInterleavedWithIntraLineDiffs(
+		pairs, aIsPrimary, aFile, bFile, nil, w, printLineNumbers)
+}
+
+// Like FormatInterleaved, but if intraLineDiffs is not nil, each changed line
+// that has an IntraLineDiff is followed by a line with carets (^) under the
+// changed characters.
+func FormatInterleavedWithIntraLineDiffs(pairs []*BlockPair, aIsPrimary bool,
+	aFile, bFile *File, intraLineDiffs *IntraLineDiffs, w io.Writer,
+	printLineNumbers bool) error {
+	return formatInterleaved(pairs, aIsPrimary, aFile, bFile, intraLineDiffs, w,
+		printLineNumbers, false)
+}
+
+// Like FormatInterleavedWithIntraLineDiffs, but colors the output with ANSI
+// escape sequences: deleted lines are red, inserted lines are green, and the
+// changed characters of lines with an IntraLineDiff are shown in reverse
+// video (in place of the line with carets).
+func FormatColoredInterleaved(pairs []*BlockPair, aIsPrimary bool,
+	aFile, bFile *File, intraLineDiffs *IntraLineDiffs, w io.Writer,
+	printLineNumbers bool) error {
+	return formatInterleaved(pairs, aIsPrimary, aFile, bFile, intraLineDiffs, w,
+		printLineNumbers, true)
+}
+
+func formatInterleaved(pairs []*BlockPair, aIsPrimary bool,
+	aFile, bFile *File, intraLineDiffs *IntraLineDiffs, w io.Writer,
+	printLineNumbers, color bool) error {
 	pairs = append([]*BlockPair(nil), pairs...)
 	if aIsPrimary {
 		SortBlockPairsByAIndex(pairs)
@@ -16,35 +47,62 @@ func FormatInterleaved(pairs []*BlockPair, aIsPrimary bool, aFile, bFile *File,
 		SortBlockPairsByBIndex(pairs)
 	}
 	maxDigits := DigitCount(MaxInt(aFile.LineCount(), bFile.LineCount()))
-	inMove := false
+	moves := findDisplayedMoves(pairs, aIsPrimary)
+	colorIf := func(text, c string) string {
+		if color {
+			return colorize(text, c)
+		}
+		return text
+	}
+	// Marks the location in the secondary file of the moves whose location
+	// is just before the pair with index n.
+	writeMovedAway := func(n int) error {
+		for _, move := range moves.movedAwayBefore[n] {
+			aLines := formatLineRange(move.aStart, move.aBeyond)
+			bLines := formatLineRange(move.bStart, move.bBeyond)
+			text := fmt.Sprintf("Move %d: lines %s moved to lines %s", move.id, aLines, bLines)
+			if aIsPrimary {
+				text = fmt.Sprintf("Move %d: lines %s moved from lines %s", move.id, bLines, aLines)
+			}
+			if _, err := fmt.Fprintln(w, colorIf(text, ansiMagenta)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var currentMove *displayedMove
 	for bn, bp := range pairs {
-		glog.V(3).Infof("FormatInterleaved processing %d: %v", bp)
+		glog.V(3).Infof("FormatInterleaved processing %d: %v", bn, bp)
+		move := moves.moveOfPair[bp]
+		if currentMove != nil && move != currentMove {
+			text := fmt.Sprintf("End of move %d -----------------------------------", currentMove.id)
+			if _, err := fmt.Fprintln(w, colorIf(text, ansiMagenta)); err != nil {
+				return err
+			}
+		}
 		if bn != 0 {
 			fmt.Fprintln(w)
 		}
-
-		stoppingMove := false
-		startingMove := false
-		if inMove && !bp.IsMove {
-			// Reached the end of a move (TODO make sure to update if meaning of
-			// IsMove changes, i.e. I figure out which set of blocks represents the
-			// small move).
-			stoppingMove = false
-		} else if bp.IsMove {
-			startingMove = true
-			inMove = true
+		if err := writeMovedAway(bn); err != nil {
+			return err
 		}
 
-		// Come up with a better visual display.
 		var err error
-		if startingMove {
-			_, err = fmt.Fprintln(w, "Start of move +++++++++++++++++++++++++++++++++")
-		} else if stoppingMove {
-			_, err = fmt.Fprintln(w, "End of move -----------------------------------")
+		if move != nil && move != currentMove {
+			var text string
+			if aIsPrimary {
+				text = fmt.Sprintf("Start of move %d, moved to lines %s", move.id,
+					formatLineRange(move.bStart, move.bBeyond))
+			} else {
+				text = fmt.Sprintf("Start of move %d, moved from lines %s", move.id,
+					formatLineRange(move.aStart, move.aBeyond))
+			}
+			_, err = fmt.Fprintln(w, colorIf(text+" +++++++++++++++++++++++++++++++++", ansiMagenta))
 		}
 		if err != nil {
 			return err
 		}
+		currentMove = move
 
 		printLines := func(f *File, start, length int, prefix rune) error {
 			glog.V(3).Infof("printLines [%d, %d) of file %s", start, start+length, f.Name)
@@ -55,10 +113,52 @@ func FormatInterleaved(pairs []*BlockPair, aIsPrimary bool, aFile, bFile *File,
 						return err
 					}
 				}
+				line := f.GetLineBytes(n)
+				var changedRanges []IndexPair
+				if prefix == '-' {
+					if d := intraLineDiffs.ForALine(n); d != nil {
+						changedRanges, _ = d.ChangedByteRanges()
+					}
+				} else if prefix == '+' {
+					if d := intraLineDiffs.ForBLine(n); d != nil {
+						_, changedRanges = d.ChangedByteRanges()
+					}
+				}
+				if color {
+					lineColor := ""
+					if prefix == '-' {
+						lineColor = ansiRed
+					} else if prefix == '+' {
+						lineColor = ansiGreen
+					}
+					text := bytes.TrimRight(line, "\r\n")
+					coloredText := colorize(string(text), lineColor)
+					if len(changedRanges) > 0 {
+						coloredText = colorizeWithHighlights(
+							text, changedBytesMask(len(text), changedRanges), lineColor)
+					}
+					if _, err := fmt.Fprint(w, colorize(string(prefix), lineColor), "\t",
+						coloredText, string(line[len(text):])); err != nil {
+						return err
+					}
+					continue
+				}
 				fmt.Fprint(w, string(prefix), "\t")
-				if _, err := w.Write(f.GetLineBytes(n)); err != nil {
+				if _, err := w.Write(line); err != nil {
 					return err
 				}
+				if len(changedRanges) > 0 {
+					if !bytes.HasSuffix(line, []byte("\n")) {
+						fmt.Fprintln(w)
+					}
+					if printLineNumbers {
+						fmt.Fprint(w, strings.Repeat(" ", maxDigits+1))
+					}
+					fmt.Fprint(w, " \t")
+					if _, err := w.Write(makeCaretLine(line, changedRanges)); err != nil {
+						return err
+					}
+				}
 			}
 			return nil
 		}
@@ -84,8 +184,9 @@ func FormatInterleaved(pairs []*BlockPair, aIsPrimary bool, aFile, bFile *File,
 			continue
 		}
 
-		_, err = fmt.Fprint(w, "@@ -", formatStartAndLength(bp.AIndex+1, bp.ALength), " +",
-			formatStartAndLength(bp.BIndex+1, bp.BLength), " @@\n")
+		header := fmt.Sprint("@@ -", formatStartAndLength(bp.AIndex+1, bp.ALength), " +",
+			formatStartAndLength(bp.BIndex+1, bp.BLength), " @@")
+		_, err = fmt.Fprintln(w, colorIf(header, ansiCyan))
 		if err != nil {
 			return err
 		}
@@ -99,6 +200,42 @@ func FormatInterleaved(pairs []*BlockPair, aIsPrimary bool, aFile, bFile *File,
 			return err
 		}
 	}
+	if currentMove != nil {
+		text := fmt.Sprintf("End of move %d -----------------------------------", currentMove.id)
+		if _, err := fmt.Fprintln(w, colorIf(text, ansiMagenta)); err != nil {
+			return err
+		}
+	}
+	return writeMovedAway(len(pairs))
+}
 
-	return nil
+// Produces a line which, when printed below line, has carets under the
+// characters in the changed ranges, and otherwise has whitespace (tabs
+// where line has tabs, so that the carets line up).
+func makeCaretLine(line []byte, changedRanges []IndexPair) []byte {
+	var caretLine []byte
+	offset, lastCaret := 0, 0
+	for offset < len(line) {
+		r, size := utf8.DecodeRune(line[offset:])
+		changed := false
+		for _, cr := range changedRanges {
+			if cr.Index1 <= offset && offset < cr.Index2 {
+				changed = true
+				break
+			}
+		}
+		if r == '\n' || r == '\r' {
+			// Suppress
+		} else if changed {
+			caretLine = append(caretLine, '^')
+			lastCaret = len(caretLine)
+		} else if r == '\t' {
+			caretLine = append(caretLine, '\t')
+		} else {
+			caretLine = append(caretLine, ' ')
+		}
+		offset += size
+	}
+	caretLine = append(caretLine[0:lastCaret], '\n')
+	return caretLine
 }
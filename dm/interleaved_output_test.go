@@ -0,0 +1,43 @@
+package dm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFormatInterleavedAnnotatesMoves(t *testing.T) {
+	aFile, bFile, pairs := performTestDiff2(t, "move_edit_1", "move_edit_2")
+	var buf bytes.Buffer
+	if err := FormatInterleaved(pairs, false, aFile, bFile, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	s := buf.String()
+	start := strings.Index(s, "Start of move ")
+	end := strings.Index(s, "End of move ")
+	if start < 0 || end < start {
+		t.Fatalf("Missing start or end of move:\n%s", s)
+	}
+	if !strings.Contains(s[start:], ", moved from lines 1-6 +++") {
+		t.Errorf("Start of move doesn't give the source lines:\n%s", s)
+	}
+	if !strings.Contains(s, ": lines 1-6 moved to lines 9-14\n") {
+		t.Errorf("Source of move isn't marked:\n%s", s)
+	}
+	// The edit within the moved block is shown relative to its original text.
+	edit := " 3 -\t  a2();\n11 +\t  a2(x);\n"
+	if n := strings.Index(s, edit); n < start || n > end {
+		t.Errorf("Edit within the moved block isn't shown within the move:\n%s", s)
+	}
+
+	// With A as primary, the destination is given instead.
+	buf.Reset()
+	if err := FormatInterleaved(pairs, true, aFile, bFile, &buf, true); err != nil {
+		t.Fatal(err)
+	}
+	s = buf.String()
+	if !strings.Contains(s, ", moved to lines 9-14 +++") ||
+		!strings.Contains(s, ": lines 9-14 moved from lines 1-6\n") {
+		t.Errorf("Unexpected move annotations with A as primary:\n%s", s)
+	}
+}
@@ -0,0 +1,252 @@
+package dm
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+// Once the lines of two files have been aligned, the lines that were changed
+// can be compared at a finer granularity: here the lines are split into
+// tokens (words, runs of whitespace, and individual punctuation characters),
+// and the tokens are aligned using the same weighted LCS that is used for
+// aligning lines. The result is expressed as BlockPairs where the indices and
+// lengths are of tokens rather than lines.
+
+// Splits a line into tokens: runs of letters, digits and underscores; runs of
+// whitespace (including the line terminator); and single other characters.
+// Concatenating the tokens reproduces the line.
+func TokenizeLine(line []byte) (tokens [][]byte) {
+	const (
+		otherClass = iota
+		wordClass
+		spaceClass
+	)
+	classOf := func(r rune) int {
+		if r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return wordClass
+		} else if unicode.IsSpace(r) {
+			return spaceClass
+		}
+		return otherClass
+	}
+	start := 0
+	for start < len(line) {
+		r, size := utf8.DecodeRune(line[start:])
+		class := classOf(r)
+		beyond := start + size
+		if class != otherClass {
+			for beyond < len(line) {
+				r, size = utf8.DecodeRune(line[beyond:])
+				if classOf(r) != class {
+					break
+				}
+				beyond += size
+			}
+		}
+		tokens = append(tokens, line[start:beyond])
+		start = beyond
+	}
+	return
+}
+
+// Describes the differences between a line in file A and a line in file B.
+type IntraLineDiff struct {
+	// Indices of the lines in their files.
+	AIndex, BIndex int
+
+	ATokens, BTokens [][]byte
+
+	// The alignment of the tokens, in order, covering all of the tokens of
+	// both lines. The indices and lengths are of tokens.
+	Pairs BlockPairs
+}
+
+// Aligns the tokens of the two lines.
+func DiffTokens(aTokens, bTokens [][]byte) (pairs BlockPairs) {
+	lcs, _ := WeightedLCS(len(aTokens), len(bTokens), func(aIndex, bIndex int) float32 {
+		if string(aTokens[aIndex]) == string(bTokens[bIndex]) {
+			return 1
+		}
+		return 0
+	})
+	aLo, bLo := 0, 0
+	addPair := func(aHi, bHi int, isMatch bool) {
+		if aLo == aHi && bLo == bHi {
+			return
+		}
+		if n := len(pairs); n > 0 && pairs[n-1].IsMatch == isMatch {
+			// Extend the previous pair.
+			pairs[n-1].ALength = aHi - pairs[n-1].AIndex
+			pairs[n-1].BLength = bHi - pairs[n-1].BIndex
+		} else {
+			pairs = append(pairs, &BlockPair{
+				AIndex:  aLo,
+				ALength: aHi - aLo,
+				BIndex:  bLo,
+				BLength: bHi - bLo,
+				IsMatch: isMatch,
+			})
+		}
+		aLo, bLo = aHi, bHi
+	}
+	for _, ip := range lcs {
+		addPair(ip.Index1, ip.Index2, false)
+		addPair(ip.Index1+1, ip.Index2+1, true)
+	}
+	addPair(len(aTokens), len(bTokens), false)
+	return
+}
+
+func DiffLines(aFile *File, aIndex int, bFile *File, bIndex int) *IntraLineDiff {
+	p := &IntraLineDiff{
+		AIndex:  aIndex,
+		BIndex:  bIndex,
+		ATokens: TokenizeLine(aFile.GetLineBytes(aIndex)),
+		BTokens: TokenizeLine(bFile.GetLineBytes(bIndex)),
+	}
+	p.Pairs = DiffTokens(p.ATokens, p.BTokens)
+	return p
+}
+
+// Returns the fraction of the characters of the two lines that are in
+// matching tokens (0 for completely different, 1 for the same).
+func (p *IntraLineDiff) Similarity() float32 {
+	matched, total := 0, 0
+	for _, pair := range p.Pairs {
+		aBytes := tokensLength(p.ATokens[pair.AIndex:pair.ABeyond()])
+		bBytes := tokensLength(p.BTokens[pair.BIndex:pair.BBeyond()])
+		if pair.IsMatch {
+			matched += aBytes + bBytes
+		}
+		total += aBytes + bBytes
+	}
+	if total == 0 {
+		return 1
+	}
+	return float32(matched) / float32(total)
+}
+
+// Returns the ranges of bytes (as offsets from the start of the lines) that
+// are in the changed tokens of each line.
+func (p *IntraLineDiff) ChangedByteRanges() (aRanges, bRanges []IndexPair) {
+	for _, pair := range p.Pairs {
+		if pair.IsMatch {
+			continue
+		}
+		if pair.ALength > 0 {
+			aRanges = append(aRanges, tokenByteRange(p.ATokens, pair.AIndex, pair.ABeyond()))
+		}
+		if pair.BLength > 0 {
+			bRanges = append(bRanges, tokenByteRange(p.BTokens, pair.BIndex, pair.BBeyond()))
+		}
+	}
+	return
+}
+
+func tokensLength(tokens [][]byte) (length int) {
+	for _, token := range tokens {
+		length += len(token)
+	}
+	return
+}
+
+// Returns the offsets of the start and end of the tokens [start, beyond).
+func tokenByteRange(tokens [][]byte, start, beyond int) IndexPair {
+	offset := tokensLength(tokens[0:start])
+	return IndexPair{offset, offset + tokensLength(tokens[start:beyond])}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// The IntraLineDiffs of the changed lines of two files.
+type IntraLineDiffs struct {
+	byALine, byBLine map[int]*IntraLineDiff
+}
+
+func (s *IntraLineDiffs) ForALine(aIndex int) *IntraLineDiff {
+	if s == nil {
+		return nil
+	}
+	return s.byALine[aIndex]
+}
+
+func (s *IntraLineDiffs) ForBLine(bIndex int) *IntraLineDiff {
+	if s == nil {
+		return nil
+	}
+	return s.byBLine[bIndex]
+}
+
+func (s *IntraLineDiffs) add(p *IntraLineDiff) {
+	s.byALine[p.AIndex] = p
+	s.byBLine[p.BIndex] = p
+}
+
+// Lines of changed blocks are only paired up if they are at least this
+// similar (see IntraLineDiff.Similarity).
+const minIntraLineSimilarity = 0.5
+
+// Pairing up the lines of a changed block compares every line of A with every
+// line of B, so blocks with more than this many combinations aren't paired.
+const maxIntraLinePairingCells = 10000
+
+// The second pass over the output of PerformDiff2: for each BlockPair whose
+// lines are changed (i.e. not an exact match), pair up the most similar
+// lines of A and B, in order, and compute the token level differences
+// between them.
+func PerformIntraLineDiff(aFile, bFile *File, pairs BlockPairs) *IntraLineDiffs {
+	result := &IntraLineDiffs{
+		byALine: make(map[int]*IntraLineDiff),
+		byBLine: make(map[int]*IntraLineDiff),
+	}
+	for _, pair := range pairs {
+		if (pair.IsMatch && !pair.IsNormalizedMatch) || pair.ALength == 0 || pair.BLength == 0 {
+			continue
+		}
+		if pair.IsMatch || pair.IsNormalizedMatch {
+			// The lines are already paired.
+			for n := 0; n < pair.ALength && n < pair.BLength; n++ {
+				result.add(DiffLines(aFile, pair.AIndex+n, bFile, pair.BIndex+n))
+			}
+			continue
+		}
+		if pair.ALength*pair.BLength > maxIntraLinePairingCells {
+			glog.V(1).Infof("PerformIntraLineDiff skipping block of %d by %d lines",
+				pair.ALength, pair.BLength)
+			continue
+		}
+		// Compare all of the lines of A with all of those in B, and choose the
+		// pairings with a weighted LCS. Only the similarities are needed for
+		// that, so the diffs are computed again for the chosen pairs.
+		aTokens := make([][][]byte, pair.ALength)
+		for i := range aTokens {
+			aTokens[i] = TokenizeLine(aFile.GetLineBytes(pair.AIndex + i))
+		}
+		bTokens := make([][][]byte, pair.BLength)
+		for j := range bTokens {
+			bTokens[j] = TokenizeLine(bFile.GetLineBytes(pair.BIndex + j))
+		}
+		lcs, _ := WeightedLCS(pair.ALength, pair.BLength, func(i, j int) float32 {
+			d := &IntraLineDiff{ATokens: aTokens[i], BTokens: bTokens[j]}
+			d.Pairs = DiffTokens(d.ATokens, d.BTokens)
+			if similarity := d.Similarity(); similarity >= minIntraLineSimilarity {
+				return similarity
+			}
+			return 0
+		})
+		for _, ip := range lcs {
+			d := &IntraLineDiff{
+				AIndex:  pair.AIndex + ip.Index1,
+				BIndex:  pair.BIndex + ip.Index2,
+				ATokens: aTokens[ip.Index1],
+				BTokens: bTokens[ip.Index2],
+			}
+			d.Pairs = DiffTokens(d.ATokens, d.BTokens)
+			result.add(d)
+		}
+	}
+	glog.Infof("PerformIntraLineDiff paired %d lines", len(result.byBLine))
+	return result
+}
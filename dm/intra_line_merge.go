@@ -0,0 +1,133 @@
+package dm
+
+import (
+	"bytes"
+
+	"github.com/golang/glog"
+)
+
+// Resolves conflicts where yours and theirs have changed the same lines, but
+// have changed different parts of those lines; for example:
+//
+//	Base                 |   Yours                |   Theirs
+//	if (y == x + 19) {   |   if (y == x + 17) {   |   if (z == x + 19) {
+//	                     |                ^^      |       ^
+//
+// The lines of base are aligned, token by token, with the corresponding lines
+// of yours and of theirs (see DiffTokens), and if the tokens changed by yours
+// are far enough from the tokens changed by theirs, both sets of changes are
+// applied.
+
+// A replacement of the base tokens [BaseStart, BaseBeyond) with the
+// replacement tokens.
+type tokenEdit struct {
+	BaseStart, BaseBeyond int
+	Replacement           [][]byte
+}
+
+func findTokenEdits(baseTokens, otherTokens [][]byte) (edits []tokenEdit) {
+	for _, pair := range DiffTokens(baseTokens, otherTokens) {
+		if pair.IsMatch {
+			continue
+		}
+		edits = append(edits, tokenEdit{
+			BaseStart:   pair.AIndex,
+			BaseBeyond:  pair.ABeyond(),
+			Replacement: otherTokens[pair.BIndex:pair.BBeyond()],
+		})
+	}
+	return
+}
+
+// Are the two edits separated by at least minTokenDistance unchanged tokens
+// (or are they the same edit)? Two insertions at the same place are never
+// considered separate, as we can't tell which should be first.
+func tokenEditsAreSeparate(e, f tokenEdit, minTokenDistance int) bool {
+	if e.BaseStart == f.BaseStart && e.BaseBeyond == f.BaseBeyond &&
+		bytes.Equal(bytes.Join(e.Replacement, nil), bytes.Join(f.Replacement, nil)) {
+		return true
+	}
+	if f.BaseStart < e.BaseStart {
+		e, f = f, e
+	}
+	if e.BaseStart == f.BaseStart {
+		return false
+	}
+	return f.BaseStart-e.BaseBeyond >= minTokenDistance && f.BaseStart >= e.BaseBeyond
+}
+
+// Attempts to merge the changes made by yours and by theirs to a single line
+// of base, returning the merged line if successful.
+func MergeIntraLineChanges(baseLine, yoursLine, theirsLine []byte,
+	minTokenDistance int) (merged []byte, ok bool) {
+	baseTokens := TokenizeLine(baseLine)
+	yEdits := findTokenEdits(baseTokens, TokenizeLine(yoursLine))
+	tEdits := findTokenEdits(baseTokens, TokenizeLine(theirsLine))
+	for _, yEdit := range yEdits {
+		for _, tEdit := range tEdits {
+			if !tokenEditsAreSeparate(yEdit, tEdit, minTokenDistance) {
+				return nil, false
+			}
+		}
+	}
+	// Apply the edits, in order of their position in base; an edit made by
+	// both yours and theirs is applied once.
+	var buf bytes.Buffer
+	baseIndex, yi, ti := 0, 0, 0
+	for baseIndex <= len(baseTokens) {
+		var edit *tokenEdit
+		if yi < len(yEdits) && yEdits[yi].BaseStart == baseIndex {
+			edit = &yEdits[yi]
+			yi++
+			if ti < len(tEdits) && tEdits[ti].BaseStart == baseIndex {
+				ti++ // Same edit.
+			}
+		} else if ti < len(tEdits) && tEdits[ti].BaseStart == baseIndex {
+			edit = &tEdits[ti]
+			ti++
+		}
+		if edit != nil {
+			for _, token := range edit.Replacement {
+				buf.Write(token)
+			}
+			baseIndex = MaxInt(baseIndex, edit.BaseBeyond)
+			if edit.BaseStart < edit.BaseBeyond {
+				continue
+			}
+		}
+		if baseIndex < len(baseTokens) {
+			buf.Write(baseTokens[baseIndex])
+		}
+		baseIndex++
+	}
+	return buf.Bytes(), true
+}
+
+// Attempts to resolve the conflict by merging the changes that yours and
+// theirs made within each line. Only applies if yours, base and theirs have
+// the same number of lines in the conflict, so that lines can be paired up.
+func ResolveIntraLineConflict(yours, base, theirs *File, triple *Diff3Triple,
+	minTokenDistance int) (resolved [][]byte, ok bool) {
+	yStart, yBeyond := triple.YoursRange()
+	tStart, tBeyond := triple.TheirsRange()
+	length := triple.BaseBeyond - triple.BaseStart
+	if length == 0 || yBeyond-yStart != length || tBeyond-tStart != length {
+		return nil, false
+	}
+	for n := 0; n < length; n++ {
+		merged, ok := MergeIntraLineChanges(
+			base.GetLineBytes(triple.BaseStart+n),
+			yours.GetLineBytes(yStart+n),
+			theirs.GetLineBytes(tStart+n),
+			minTokenDistance)
+		if !ok {
+			glog.V(1).Infof("ResolveIntraLineConflict: changes to base line %d overlap",
+				triple.BaseStart+n)
+			return nil, false
+		}
+		resolved = append(resolved, merged)
+	}
+	glog.Infof("ResolveIntraLineConflict resolved base lines [%d, %d)",
+		triple.BaseStart, triple.BaseBeyond)
+	return resolved, true
+}
@@ -0,0 +1,84 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeLine(t *testing.T) {
+	line := []byte("  if (a_1 <= b) { // héllo\n")
+	tokens := TokenizeLine(line)
+	var got []string
+	for _, token := range tokens {
+		got = append(got, string(token))
+	}
+	want := []string{"  ", "if", " ", "(", "a_1", " ", "<", "=", " ", "b", ")",
+		" ", "{", " ", "/", "/", " ", "héllo", "\n"}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("TokenizeLine(%q)\n got: %q\nwant: %q", line, got, want)
+	}
+	if joined := bytes.Join(tokens, nil); !bytes.Equal(joined, line) {
+		t.Errorf("Tokens don't reproduce the line: %q", joined)
+	}
+	if tokens := TokenizeLine(nil); len(tokens) != 0 {
+		t.Errorf("Expected no tokens for an empty line, not %q", tokens)
+	}
+}
+
+func TestChangedByteRanges(t *testing.T) {
+	aFile, _ := BuildFile("a", []byte("x = foo(1);\n"))
+	bFile, _ := BuildFile("b", []byte("x = bar(1, 2);\n"))
+	d := DiffLines(aFile, 0, bFile, 0)
+	aRanges, bRanges := d.ChangedByteRanges()
+	if fmt.Sprint(aRanges) != fmt.Sprint([]IndexPair{{4, 7}}) {
+		t.Errorf("Wrong changed ranges of A: %v", aRanges)
+	}
+	if fmt.Sprint(bRanges) != fmt.Sprint([]IndexPair{{4, 7}, {9, 12}}) {
+		t.Errorf("Wrong changed ranges of B: %v", bRanges)
+	}
+	if s := d.Similarity(); s <= 0 || s >= 1 {
+		t.Errorf("Expected a similarity between 0 and 1, not %v", s)
+	}
+
+	d = DiffLines(aFile, 0, aFile, 0)
+	if aRanges, bRanges := d.ChangedByteRanges(); len(aRanges)+len(bRanges) != 0 {
+		t.Errorf("Expected no changes between identical lines: %v, %v", aRanges, bRanges)
+	}
+	if s := d.Similarity(); s != 1 {
+		t.Errorf("Expected identical lines to have similarity 1, not %v", s)
+	}
+}
+
+func TestPerformIntraLineDiffPairsSimilarLines(t *testing.T) {
+	aFile, _ := BuildFile("a", []byte("int x = 1;\nfoo();\n"))
+	bFile, _ := BuildFile("b", []byte("bar();\nint x = 2;\nfoo(x);\n"))
+	pairs := BlockPairs{&BlockPair{AIndex: 0, ALength: 2, BIndex: 0, BLength: 3}}
+	diffs := PerformIntraLineDiff(aFile, bFile, pairs)
+	if d := diffs.ForBLine(0); d != nil {
+		t.Errorf("Inserted line shouldn't be paired: %+v", d)
+	}
+	for aIndex, bIndex := range []int{1, 2} {
+		d := diffs.ForALine(aIndex)
+		if d == nil || d.BIndex != bIndex {
+			t.Errorf("Expected A line %d to be paired with B line %d: %+v", aIndex, bIndex, d)
+		} else if diffs.ForBLine(bIndex) != d {
+			t.Errorf("B line %d isn't paired with A line %d", bIndex, aIndex)
+		}
+	}
+}
+
+func TestPerformIntraLineDiffSkipsLargeBlocks(t *testing.T) {
+	n := 101 // n*n > maxIntraLinePairingCells
+	aFile, _ := BuildFile("a", []byte(strings.Repeat("a = 1;\n", n)))
+	bFile, _ := BuildFile("b", []byte(strings.Repeat("a = 2;\n", n)))
+	pairs := BlockPairs{&BlockPair{AIndex: 0, ALength: n, BIndex: 0, BLength: n}}
+	if d := PerformIntraLineDiff(aFile, bFile, pairs).ForALine(0); d != nil {
+		t.Errorf("Expected a block of %d by %d lines to be skipped: %+v", n, n, d)
+	}
+	pairs[0].ALength, pairs[0].BLength = 2, 2
+	if d := PerformIntraLineDiff(aFile, bFile, pairs).ForALine(0); d == nil {
+		t.Errorf("Expected a block of 2 by 2 lines to be paired")
+	}
+}
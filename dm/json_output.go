@@ -0,0 +1,235 @@
+package dm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A machine-readable representation of the output of PerformDiff2: the
+// BlockPairs, along with metadata about the two files and (optionally) their
+// lines, for consumption by other tools. The schema is versioned; fields may
+// be added without changing the version, but any other change to the schema
+// requires incrementing DiffJSONSchemaVersion.
+
+const DiffJSONSchemaVersion = 1
+
+// Values of DiffJSONPair.Kind.
+const (
+	// The lines are identical.
+	JSONMatchKind = "match"
+	// The lines are the same after normalization.
+	JSONNormalizedMatchKind = "normalized_match"
+	// The lines are the same after normalization, and some or all of them are
+	// identical (see BlockPair.IsNormalizedMatch).
+	JSONMixedMatchKind = "mixed_match"
+	// The lines are different (or only present in one of the files).
+	JSONMismatchKind = "mismatch"
+)
+
+type DiffJSONFile struct {
+	Name      string `json:"name"`
+	Label     string `json:"label,omitempty"`
+	LineCount int    `json:"line_count"`
+
+	// The lines of the file, each including its line terminator, if any.
+	// Omitted unless requested. Bytes that aren't valid UTF-8 are replaced.
+	Lines []string `json:"lines,omitempty"`
+}
+
+type DiffJSONIndentationChange struct {
+	Removed string `json:"removed"`
+	Added   string `json:"added"`
+}
+
+type DiffJSONPair struct {
+	AIndex  int    `json:"a_index"`
+	ALength int    `json:"a_length"`
+	BIndex  int    `json:"b_index"`
+	BLength int    `json:"b_length"`
+	Kind    string `json:"kind"`
+	IsMove  bool   `json:"is_move,omitempty"`
+	MoveId  int    `json:"move_id,omitempty"`
+
+	IndentationChange *DiffJSONIndentationChange `json:"indentation_change,omitempty"`
+}
+
+type DiffJSON struct {
+	SchemaVersion int            `json:"schema_version"`
+	A             DiffJSONFile   `json:"a"`
+	B             DiffJSONFile   `json:"b"`
+	Pairs         []DiffJSONPair `json:"pairs"`
+}
+
+func makeDiffJSONFile(f *File, includeLines bool) DiffJSONFile {
+	result := DiffJSONFile{
+		Name:      f.Name,
+		Label:     f.Label,
+		LineCount: f.LineCount(),
+	}
+	if includeLines {
+		for n := 0; n < f.LineCount(); n++ {
+			result.Lines = append(result.Lines, string(f.GetLineBytes(n)))
+		}
+	}
+	return result
+}
+
+func jsonKindOfBlockPair(pair *BlockPair) string {
+	if pair.IsMatch && pair.IsNormalizedMatch {
+		return JSONMixedMatchKind
+	} else if pair.IsMatch {
+		return JSONMatchKind
+	} else if pair.IsNormalizedMatch {
+		return JSONNormalizedMatchKind
+	}
+	return JSONMismatchKind
+}
+
+// Creates the JSON representation of the BlockPairs, in order of AIndex.
+func MakeDiffJSON(aFile, bFile *File, pairs BlockPairs, includeLines bool) *DiffJSON {
+	result := &DiffJSON{
+		SchemaVersion: DiffJSONSchemaVersion,
+		A:             makeDiffJSONFile(aFile, includeLines),
+		B:             makeDiffJSONFile(bFile, includeLines),
+		Pairs:         []DiffJSONPair{},
+	}
+	pairs = append(BlockPairs(nil), pairs...)
+	SortBlockPairsByAIndex(pairs)
+	for _, pair := range pairs {
+		jp := DiffJSONPair{
+			AIndex:  pair.AIndex,
+			ALength: pair.ALength,
+			BIndex:  pair.BIndex,
+			BLength: pair.BLength,
+			Kind:    jsonKindOfBlockPair(pair),
+			IsMove:  pair.IsMove,
+			MoveId:  pair.MoveId,
+		}
+		if c := pair.IndentationChange; c != nil {
+			jp.IndentationChange = &DiffJSONIndentationChange{Removed: c.Removed, Added: c.Added}
+		}
+		result.Pairs = append(result.Pairs, jp)
+	}
+	return result
+}
+
+func FormatDiffJSON(aFile, bFile *File, pairs BlockPairs, includeLines bool,
+	w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(MakeDiffJSON(aFile, bFile, pairs, includeLines))
+}
+
+// Decodes the output of FormatDiffJSON, checking that the schema version is
+// one that this package supports.
+func DecodeDiffJSON(r io.Reader) (*DiffJSON, error) {
+	var result DiffJSON
+	if err := json.NewDecoder(r).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.SchemaVersion < 1 || result.SchemaVersion > DiffJSONSchemaVersion {
+		return nil, fmt.Errorf("unsupported diff JSON schema version %d (expected at most %d)",
+			result.SchemaVersion, DiffJSONSchemaVersion)
+	}
+	for n, jp := range result.Pairs {
+		switch jp.Kind {
+		case JSONMatchKind, JSONNormalizedMatchKind, JSONMixedMatchKind, JSONMismatchKind:
+		default:
+			return nil, fmt.Errorf("pairs[%d] has unknown kind %q", n, jp.Kind)
+		}
+	}
+	return &result, nil
+}
+
+// Returns the BlockPairs represented by p.
+func (p *DiffJSON) BlockPairs() (pairs BlockPairs) {
+	for _, jp := range p.Pairs {
+		pair := &BlockPair{
+			AIndex:            jp.AIndex,
+			ALength:           jp.ALength,
+			BIndex:            jp.BIndex,
+			BLength:           jp.BLength,
+			IsMatch:           jp.Kind == JSONMatchKind || jp.Kind == JSONMixedMatchKind,
+			IsNormalizedMatch: jp.Kind == JSONNormalizedMatchKind || jp.Kind == JSONMixedMatchKind,
+			IsMove:            jp.IsMove,
+			MoveId:            jp.MoveId,
+		}
+		if c := jp.IndentationChange; c != nil {
+			pair.IndentationChange = &IndentationChange{Removed: c.Removed, Added: c.Added}
+		}
+		pairs = append(pairs, pair)
+	}
+	return
+}
+
+// Returns the File represented by p, if its lines were included.
+func (p *DiffJSONFile) File() (*File, error) {
+	if len(p.Lines) != p.LineCount {
+		return nil, fmt.Errorf("the lines of %s are not included", p.Name)
+	}
+	f, err := BuildFile(p.Name, []byte(strings.Join(p.Lines, "")))
+	if err != nil {
+		return nil, err
+	}
+	f.Label = p.Label
+	return f, nil
+}
+
+// The JSON representation of a DirDiff: an entry for each file in either
+// tree, with the diff of those text files which differ.
+type DirDiffJSONEntry struct {
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	Status  string    `json:"status"`
+	Diff    *DiffJSON `json:"diff,omitempty"`
+}
+
+// A block of lines moved from the file with APath in tree A to the file with
+// BPath in tree B.
+type DirDiffJSONMove struct {
+	Id    int            `json:"id"`
+	APath string         `json:"a_path"`
+	BPath string         `json:"b_path"`
+	Pairs []DiffJSONPair `json:"pairs"`
+}
+
+type DirDiffJSON struct {
+	SchemaVersion int                `json:"schema_version"`
+	ADir          string             `json:"a_dir"`
+	BDir          string             `json:"b_dir"`
+	Files         []DirDiffJSONEntry `json:"files"`
+	Moves         []DirDiffJSONMove  `json:"moves,omitempty"`
+}
+
+func MakeDirDiffJSON(dirDiff *DirDiff, includeLines bool) *DirDiffJSON {
+	result := &DirDiffJSON{
+		SchemaVersion: DiffJSONSchemaVersion,
+		ADir:          dirDiff.ADir,
+		BDir:          dirDiff.BDir,
+		Files:         []DirDiffJSONEntry{},
+	}
+	for _, entry := range dirDiff.Entries {
+		je := DirDiffJSONEntry{Path: entry.Path, OldPath: entry.OldPath, Status: entry.Status.String()}
+		if entry.Status == FilesDiffer || entry.Status == FileRenamed {
+			je.Diff = MakeDiffJSON(entry.AFile, entry.BFile, entry.Pairs, includeLines)
+		}
+		result.Files = append(result.Files, je)
+	}
+	for _, move := range dirDiff.Moves {
+		result.Moves = append(result.Moves, DirDiffJSONMove{
+			Id:    move.Id,
+			APath: move.AEntry.APathInTree(),
+			BPath: move.BEntry.Path,
+			Pairs: MakeDiffJSON(move.AEntry.AFile, move.BEntry.BFile, move.Pairs, false).Pairs,
+		})
+	}
+	return result
+}
+
+func FormatDirDiffJSON(dirDiff *DirDiff, includeLines bool, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(MakeDirDiffJSON(dirDiff, includeLines))
+}
@@ -0,0 +1,53 @@
+package dm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiffJSONRoundTrip(t *testing.T) {
+	aFile, bFile, pairs := performTestDiff2(t, "indent_base", "indent_yours")
+	var buf bytes.Buffer
+	if err := FormatDiffJSON(aFile, bFile, pairs, true, &buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeDiffJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SchemaVersion != DiffJSONSchemaVersion {
+		t.Errorf("Unexpected schema version: %d", decoded.SchemaVersion)
+	}
+	expectedPairs := append(BlockPairs(nil), pairs...)
+	SortBlockPairsByAIndex(expectedPairs)
+	decodedPairs := decoded.BlockPairs()
+	if len(decodedPairs) != len(expectedPairs) {
+		t.Fatalf("Decoded %d pairs, expected %d", len(decodedPairs), len(expectedPairs))
+	}
+	for n, pair := range decodedPairs {
+		e := expectedPairs[n]
+		if !BlockPairsAreSameType(pair, e) || pair.AIndex != e.AIndex ||
+			pair.ALength != e.ALength || pair.BIndex != e.BIndex || pair.BLength != e.BLength {
+			t.Errorf("Decoded pair %d is %v, expected %v", n, pair, e)
+		}
+	}
+	decodedA, err := decoded.A.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedB, err := decoded.B.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decodedA.Body, aFile.Body) || !bytes.Equal(decodedB.Body, bFile.Body) {
+		t.Errorf("Decoded files differ from the originals")
+	}
+}
+
+func TestDecodeDiffJSONRejectsNewerSchema(t *testing.T) {
+	_, err := DecodeDiffJSON(strings.NewReader(`{"schema_version": 2, "pairs": []}`))
+	if err == nil {
+		t.Errorf("Expected an error for an unsupported schema version")
+	}
+}
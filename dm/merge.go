@@ -0,0 +1,521 @@
+package dm
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/golang/glog"
+)
+
+// Produces a merged file from the Diff3Triples of yours, base and theirs
+// (as computed by PerformDiff3), in the manner of merge(1): changes made in
+// only one of yours and theirs are applied, changes made identically in both
+// are applied once, and conflicting changes are written out between
+// conflict markers:
+//
+//	<<<<<<< yours
+//	lines from yours
+//	=======
+//	lines from theirs
+//	>>>>>>> theirs
+//
+// The conflict style determines whether the base lines are included too.
+
+type ConflictStyle int
+
+const (
+	// Conflicts include just the lines of yours and theirs.
+	MergeConflictStyle ConflictStyle = iota
+	// Conflicts also include the base lines, between "|||||||" and "=======".
+	Diff3ConflictStyle
+	// Like Diff3ConflictStyle, but lines shared by yours and theirs at the
+	// start and end of the conflict are moved outside of the conflict markers.
+	ZealousDiff3ConflictStyle
+)
+
+var conflictStyleNames = map[ConflictStyle]string{
+	MergeConflictStyle:        "merge",
+	Diff3ConflictStyle:        "diff3",
+	ZealousDiff3ConflictStyle: "zdiff3",
+}
+
+func (s ConflictStyle) String() string {
+	if name, ok := conflictStyleNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConflictStyle(%d)", int(s))
+}
+
+func ParseConflictStyle(name string) (ConflictStyle, error) {
+	for style, styleName := range conflictStyleNames {
+		if name == styleName {
+			return style, nil
+		}
+	}
+	return MergeConflictStyle, fmt.Errorf(
+		"unknown conflict style %q (expected merge, diff3 or zdiff3)", name)
+}
+
+// Implements flag.Value.
+func (s *ConflictStyle) Set(name string) (err error) {
+	*s, err = ParseConflictStyle(name)
+	return
+}
+
+// The length of conflict markers used by merge(1) and git.
+const DefaultConflictMarkerSize = 7
+
+// Guides the production of a merged file by PerformMerge.
+type MergeConfig struct {
+	// How are conflicts to be represented?
+	ConflictStyle ConflictStyle
+
+	// The number of characters in each conflict marker (e.g. "<<<<<<<"). If
+	// not positive, DefaultConflictMarkerSize is used.
+	ConflictMarkerSize int
+
+	// Should conflicts within lexically sorted lists (e.g. include lists) be
+	// resolved by applying the insertions and deletions of both yours and
+	// theirs to the list?
+	MergeSortedLists bool
+
+	// When comparing the lines of sorted lists, which characters are removed
+	// from the ends of the lines (after removing whitespace) to produce the
+	// sort key? Ignored if SortedListKey is set.
+	SortedListKeyTrim string
+
+	// Optional function for computing the sort key of lines of sorted lists.
+	SortedListKey SortKeyFunc
+
+	// Should conflicts where one side only changed the indentation of lines
+	// (perhaps also inserting lines), and the other side edited those lines, be
+	// resolved by applying the indentation changes to the edited lines?
+	MergeIndentation bool
+
+	// Should conflicts where yours and theirs changed different parts of the
+	// same lines be resolved by applying both sets of changes?
+	MergeIntraLine bool
+
+	// When merging changes within a line, how many unchanged tokens (words,
+	// whitespace runs or punctuation characters) must separate the changes?
+	MinIntraLineTokenDistance int
+
+	// Should edits made by one side to a block of lines which the other side
+	// moved be applied to the block at its new location?
+	// Used by PerformMoveAwareMerge.
+	MergeMoves bool
+
+	// Should identifiers renamed by yours also be renamed in the lines that
+	// theirs changed or inserted?
+	PropagateRenames bool
+}
+
+func (p *MergeConfig) CreateFlags(f *flag.FlagSet) {
+	f.Var(
+		&p.ConflictStyle, "conflict-style", `
+		How conflicts are written by merge: "merge" (yours and theirs),
+		"diff3" (yours, base and theirs) or "zdiff3" (as for diff3, but with
+		lines common to the start or end of yours and theirs moved out of the
+		conflict).
+		`)
+
+	f.IntVar(
+		&p.ConflictMarkerSize, "conflict-marker-size", DefaultConflictMarkerSize, `
+		The number of characters in each conflict marker (as for git's
+		conflict-marker-size attribute).
+		`)
+
+	f.BoolVar(
+		&p.MergeSortedLists, "merge-sorted-lists", true, `
+		Should conflicts within lexically sorted lists (e.g. include lists) be
+		resolved by applying the insertions and deletions of both yours and
+		theirs to the list?
+		`)
+
+	f.StringVar(
+		&p.SortedListKeyTrim, "sorted-list-key-trim", `,;"'`, `
+		When comparing the lines of sorted lists, which characters are removed
+		from the ends of the lines (after removing whitespace) to produce the
+		sort key?
+		`)
+
+	f.BoolVar(
+		&p.MergeIndentation, "merge-indentation", true, `
+		Should conflicts where one side only changed the indentation of lines
+		(perhaps also inserting lines), and the other side edited those lines,
+		be resolved by applying the indentation changes to the edited lines?
+		`)
+
+	f.BoolVar(
+		&p.MergeIntraLine, "merge-intra-line", true, `
+		Should conflicts where yours and theirs changed different parts of the
+		same lines be resolved by applying both sets of changes?
+		`)
+
+	f.IntVar(
+		&p.MinIntraLineTokenDistance, "min-intra-line-token-distance", 1, `
+		When merging changes within a line, how many unchanged tokens (words,
+		whitespace runs or punctuation characters) must separate the changes?
+		`)
+
+	f.BoolVar(
+		&p.MergeMoves, "merge-moves", true, `
+		Should edits made by one side to a block of lines which the other side
+		moved be applied to the block at its new location?
+		`)
+
+	f.BoolVar(
+		&p.PropagateRenames, "propagate-renames", false, `
+		Should identifiers renamed by yours (i.e. replaced in every line that
+		contained them) also be renamed in the lines that theirs changed or
+		inserted?
+		`)
+}
+
+func (p *MergeConfig) sortKeyFunc() SortKeyFunc {
+	if p.SortedListKey != nil {
+		return p.SortedListKey
+	}
+	return MakeTrimmingSortKeyFunc(p.SortedListKeyTrim)
+}
+
+type MergeResolutionKind int
+
+const (
+	// A conflict within a sorted list was resolved by set operations.
+	SortedListResolution MergeResolutionKind = iota
+	// Changes to different parts of the same lines were combined.
+	IntraLineResolution
+	// Edits made by one side were applied to a block moved by the other side.
+	MovedBlockResolution
+	// Edits made by one side were re-indented as the other side re-indented
+	// the base lines.
+	IndentationResolution
+)
+
+func (k MergeResolutionKind) String() string {
+	switch k {
+	case SortedListResolution:
+		return "auto-resolved sorted list"
+	case IntraLineResolution:
+		return "auto-resolved intra-line"
+	case MovedBlockResolution:
+		return "auto-resolved move"
+	case IndentationResolution:
+		return "auto-resolved indentation"
+	}
+	return fmt.Sprintf("MergeResolutionKind(%d)", int(k))
+}
+
+// Records the automatic resolution of a conflict, so that it can be reviewed.
+type MergeResolution struct {
+	Kind MergeResolutionKind
+
+	// The conflict that was resolved (nil for MovedBlockResolution).
+	Triple *Diff3Triple
+
+	// The move whose block was edited (only for MovedBlockResolution).
+	Move *MoveTransfer
+
+	// The lines of the merged file produced by the resolution.
+	OutputStart, OutputBeyond int
+}
+
+func (p *MergeResolution) String() string {
+	if p.Move != nil {
+		return fmt.Sprintf("%s: merged lines %s (base lines %s, moved by %s)", p.Kind,
+			formatLineRange(p.OutputStart, p.OutputBeyond),
+			formatLineRange(p.Move.Block.BaseStart, p.Move.Block.BaseBeyond),
+			p.Move.moverName())
+	}
+	return fmt.Sprintf("%s: merged lines %s (base lines %s)", p.Kind,
+		formatLineRange(p.OutputStart, p.OutputBeyond),
+		formatLineRange(p.Triple.BaseStart, p.Triple.BaseBeyond))
+}
+
+// Formats the zero-based half-open range [start, beyond) as one-based line
+// numbers (e.g. "3" or "3-5").
+func formatLineRange(start, beyond int) string {
+	if beyond-start <= 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d-%d", start+1, beyond)
+}
+
+// Records the renaming of identifiers in a line from theirs (see
+// MergeConfig.PropagateRenames).
+type RenameRewrite struct {
+	Renames []*Rename
+
+	// The line of theirs, and the line of the merged file it was written to.
+	TheirsIndex, OutputIndex int
+}
+
+func (p *RenameRewrite) String() string {
+	return fmt.Sprintf("propagated rename %v: merged line %d (theirs line %d)",
+		p.Renames, p.OutputIndex+1, p.TheirsIndex+1)
+}
+
+type MergeResult struct {
+	// The merged file contents.
+	Body []byte
+
+	// Number of conflicts written to Body.
+	NumConflicts int
+
+	// Conflicts that were resolved automatically, in the order in which they
+	// appear in Body.
+	Resolutions []*MergeResolution
+
+	// Lines of theirs in which identifiers renamed by yours were renamed.
+	RenameRewrites []*RenameRewrite
+}
+
+// Writes a summary of the automatic resolutions and rewrites, one per line,
+// so that they can be reviewed.
+func (p *MergeResult) FormatSummary(w io.Writer) error {
+	for _, resolution := range p.Resolutions {
+		if _, err := fmt.Fprintln(w, resolution); err != nil {
+			return err
+		}
+	}
+	for _, rewrite := range p.RenameRewrites {
+		if _, err := fmt.Fprintln(w, rewrite); err != nil {
+			return err
+		}
+	}
+	if p.NumConflicts > 0 {
+		if _, err := fmt.Fprintf(w, "%d conflicts remain\n", p.NumConflicts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func PerformMerge(yours, base, theirs *File, triples Diff3Triples,
+	config MergeConfig) *MergeResult {
+	state := newMergeState(yours, base, theirs, config)
+	state.mergeTriples(triples)
+	return state.result
+}
+
+type mergeState struct {
+	cfg                 MergeConfig
+	yours, base, theirs *File
+	buf                 bytes.Buffer
+	numOutputLines      int
+	result              *MergeResult
+
+	// Maps from the indices of lines of yours and theirs to the indices of
+	// the output lines that they were copied to.
+	yoursOutput, theirsOutput map[int]int
+
+	// Identifiers renamed by yours, to be renamed in lines from theirs.
+	renames []*Rename
+}
+
+func newMergeState(yours, base, theirs *File, config MergeConfig) *mergeState {
+	return &mergeState{
+		cfg:          config,
+		yours:        yours,
+		base:         base,
+		theirs:       theirs,
+		result:       &MergeResult{},
+		yoursOutput:  make(map[int]int),
+		theirsOutput: make(map[int]int),
+	}
+}
+
+func (p *mergeState) mergeTriples(triples Diff3Triples) {
+	if p.cfg.PropagateRenames {
+		var changedPairs BlockPairs
+		for _, triple := range triples {
+			if triple.TripleType != UnchangedTriple && triple.TripleType != TheirsChangedTriple {
+				changedPairs = append(changedPairs, triple.B2YPair)
+			}
+		}
+		p.renames = DetectRenames(p.base, p.yours, changedPairs)
+	}
+	for _, triple := range triples {
+		p.mergeTriple(triple)
+	}
+	p.result.Body = p.buf.Bytes()
+	glog.Infof("PerformMerge: %d triples, %d conflicts",
+		len(triples), p.result.NumConflicts)
+}
+
+func (p *mergeState) mergeTriple(triple *Diff3Triple) {
+	glog.V(1).Infof("mergeTriple %v", *triple)
+	switch triple.TripleType {
+	case UnchangedTriple:
+		p.recordOutput(p.yoursOutput, triple.B2YPair)
+		p.recordOutput(p.theirsOutput, triple.B2TPair)
+		p.writeLines(p.base, triple.BaseStart, triple.BaseBeyond)
+	case YoursChangedTriple, BothSameTriple:
+		p.recordOutput(p.yoursOutput, triple.B2YPair)
+		if triple.TripleType == BothSameTriple {
+			p.recordOutput(p.theirsOutput, triple.B2TPair)
+		}
+		p.writeLines(p.yours, triple.B2YPair.BIndex, triple.B2YPair.BBeyond())
+	case TheirsChangedTriple:
+		p.recordOutput(p.theirsOutput, triple.B2TPair)
+		p.writeTheirsChangedLines(triple.B2TPair.BIndex, triple.B2TPair.BBeyond())
+	case ConflictTriple:
+		if !p.resolveConflict(triple) {
+			p.writeConflict(triple)
+		}
+	default:
+		glog.Fatalf("Unknown TripleType: %v", *triple)
+	}
+}
+
+// Records that the B lines of the pair are about to be output.
+func (p *mergeState) recordOutput(outputLines map[int]int, pair *BlockPair) {
+	for n := 0; n < pair.BLength; n++ {
+		outputLines[pair.BIndex+n] = p.numOutputLines + n
+	}
+}
+
+// Attempts to automatically resolve the conflict, writing the resolution to
+// the output if successful.
+func (p *mergeState) resolveConflict(triple *Diff3Triple) bool {
+	if p.cfg.MergeSortedLists {
+		lines, ok := ResolveSortedListConflict(
+			p.yours, p.base, p.theirs, triple, p.cfg.sortKeyFunc())
+		if ok {
+			p.writeResolution(SortedListResolution, triple, lines)
+			return true
+		}
+	}
+	if p.cfg.MergeIndentation {
+		lines, ok := ResolveIndentationConflict(p.yours, p.base, p.theirs, triple)
+		if ok {
+			p.writeResolution(IndentationResolution, triple, lines)
+			return true
+		}
+	}
+	if p.cfg.MergeIntraLine {
+		lines, ok := ResolveIntraLineConflict(
+			p.yours, p.base, p.theirs, triple, p.cfg.MinIntraLineTokenDistance)
+		if ok {
+			p.writeResolution(IntraLineResolution, triple, lines)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *mergeState) writeResolution(
+	kind MergeResolutionKind, triple *Diff3Triple, lines [][]byte) {
+	resolution := &MergeResolution{
+		Kind:        kind,
+		Triple:      triple,
+		OutputStart: p.numOutputLines,
+	}
+	for _, line := range lines {
+		p.writeLine(line)
+	}
+	resolution.OutputBeyond = p.numOutputLines
+	p.result.Resolutions = append(p.result.Resolutions, resolution)
+}
+
+// Writes the lines of theirs, renaming the identifiers renamed by yours.
+func (p *mergeState) writeTheirsChangedLines(start, beyond int) {
+	for n := start; n < beyond; n++ {
+		line, applied := ApplyRenames(p.theirs.GetLineBytes(n), p.renames)
+		if len(applied) > 0 {
+			p.result.RenameRewrites = append(p.result.RenameRewrites, &RenameRewrite{
+				Renames:     applied,
+				TheirsIndex: n,
+				OutputIndex: p.numOutputLines,
+			})
+		}
+		p.writeLine(line)
+	}
+}
+
+func (p *mergeState) writeConflict(triple *Diff3Triple) {
+	p.result.NumConflicts++
+	yStart, yBeyond := triple.YoursRange()
+	tStart, tBeyond := triple.TheirsRange()
+	var prefixLength, suffixLength int
+	if p.cfg.ConflictStyle == ZealousDiff3ConflictStyle {
+		prefixLength, suffixLength = measureSharedLines(
+			p.yours, yStart, yBeyond, p.theirs, tStart, tBeyond)
+		p.writeLines(p.yours, yStart, yStart+prefixLength)
+		yStart += prefixLength
+		tStart += prefixLength
+		yBeyond -= suffixLength
+		tBeyond -= suffixLength
+	}
+	p.writeMarker('<', p.yours.DisplayName())
+	p.writeCompleteLines(p.yours, yStart, yBeyond)
+	if p.cfg.ConflictStyle != MergeConflictStyle {
+		p.writeMarker('|', p.base.DisplayName())
+		p.writeCompleteLines(p.base, triple.BaseStart, triple.BaseBeyond)
+	}
+	p.writeMarker('=', "")
+	p.writeCompleteLines(p.theirs, tStart, tBeyond)
+	p.writeMarker('>', p.theirs.DisplayName())
+	p.writeLines(p.yours, yBeyond, yBeyond+suffixLength)
+}
+
+// Writes a conflict marker of ConflictMarkerSize copies of c, followed by the
+// label, if any.
+func (p *mergeState) writeMarker(c byte, label string) {
+	size := p.cfg.ConflictMarkerSize
+	if size <= 0 {
+		size = DefaultConflictMarkerSize
+	}
+	for n := 0; n < size; n++ {
+		p.buf.WriteByte(c)
+	}
+	if label != "" {
+		p.buf.WriteByte(' ')
+		p.buf.WriteString(label)
+	}
+	p.buf.WriteByte('\n')
+	p.numOutputLines++
+}
+
+func (p *mergeState) writeLine(line []byte) {
+	p.buf.Write(line)
+	p.numOutputLines++
+}
+
+func (p *mergeState) writeLines(f *File, start, beyond int) {
+	for n := start; n < beyond; n++ {
+		p.writeLine(f.GetLineBytes(n))
+	}
+}
+
+// Like writeLines, but ensures that the output ends with a newline so that
+// a conflict marker can follow.
+func (p *mergeState) writeCompleteLines(f *File, start, beyond int) {
+	p.writeLines(f, start, beyond)
+	if start < beyond && !bytes.HasSuffix(f.GetLineBytes(beyond-1), []byte("\n")) {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// Returns the number of lines at the start and at the end of the two ranges
+// that are the same, such that the prefix and suffix don't overlap.
+func measureSharedLines(
+	aFile *File, aStart, aBeyond int, bFile *File, bStart, bBeyond int) (
+	prefixLength, suffixLength int) {
+	limit := MinInt(aBeyond-aStart, bBeyond-bStart)
+	for prefixLength < limit && bytes.Equal(
+		aFile.GetLineBytes(aStart+prefixLength),
+		bFile.GetLineBytes(bStart+prefixLength)) {
+		prefixLength++
+	}
+	limit -= prefixLength
+	for suffixLength < limit && bytes.Equal(
+		aFile.GetLineBytes(aBeyond-suffixLength-1),
+		bFile.GetLineBytes(bBeyond-suffixLength-1)) {
+		suffixLength++
+	}
+	return
+}
@@ -0,0 +1,248 @@
+package dm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPerformMergeConflict(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	result := PerformMerge(yours, base, theirs, triples, MergeConfig{})
+	if result.NumConflicts != 1 {
+		t.Errorf("Expected 1 conflict, not %d", result.NumConflicts)
+	}
+	expected := "func F(x, y int) int {\n" +
+		"<<<<<<< ../data/conflict1_yours\n" +
+		"  if (y == x + 17) {\n" +
+		"=======\n" +
+		"  if (z == x + 19) {\n" +
+		">>>>>>> ../data/conflict1_theirs\n" +
+		"    return 7\n"
+	if !strings.Contains(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't contain the expected conflict:\n%s", result.Body)
+	}
+}
+
+func TestPerformMergeNoConflict(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(t, "lao", "lao", "tzu")
+	result := PerformMerge(yours, base, theirs, triples, MergeConfig{})
+	if result.NumConflicts != 0 {
+		t.Errorf("Expected no conflicts, not %d", result.NumConflicts)
+	}
+	if string(result.Body) != string(theirs.Body) {
+		t.Errorf("Merged file should equal theirs, not:\n%s", result.Body)
+	}
+}
+
+func TestPerformMergeDiff3ConflictStyle(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	config := MergeConfig{ConflictStyle: Diff3ConflictStyle}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	expected := "  if (y == x + 17) {\n" +
+		"||||||| ../data/conflict1_base\n" +
+		"  if (y == x + 19) {\n" +
+		"=======\n"
+	if !strings.Contains(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't contain the base lines:\n%s", result.Body)
+	}
+}
+
+func TestPerformMergeZealousDiff3ConflictStyle(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "zdiff3_yours", "zdiff3_base", "zdiff3_theirs")
+	config := MergeConfig{ConflictStyle: ZealousDiff3ConflictStyle}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	if result.NumConflicts != 1 {
+		t.Errorf("Expected 1 conflict, not %d", result.NumConflicts)
+	}
+	// The lines at the start and end of the conflict that are the same in yours
+	// and theirs are moved out of it.
+	expected := "func G(x int) int {\n" +
+		"  y := x * 2\n" +
+		"<<<<<<< ../data/zdiff3_yours\n" +
+		"  y -= 1\n" +
+		"||||||| ../data/zdiff3_base\n" +
+		"  return x\n" +
+		"}\n" +
+		"=======\n" +
+		"  y += 1\n" +
+		">>>>>>> ../data/zdiff3_theirs\n" +
+		"  return y\n" +
+		"}\n"
+	if !strings.HasSuffix(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't end with the expected conflict:\n%s", result.Body)
+	}
+}
+
+// Labels (e.g. from -L) replace the names of the files in conflict markers.
+func TestPerformMergeLabels(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	yours.Label, base.Label, theirs.Label = "mine", "older", "yours"
+	config := MergeConfig{ConflictStyle: Diff3ConflictStyle}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	expected := "<<<<<<< mine\n" +
+		"  if (y == x + 17) {\n" +
+		"||||||| older\n" +
+		"  if (y == x + 19) {\n" +
+		"=======\n" +
+		"  if (z == x + 19) {\n" +
+		">>>>>>> yours\n"
+	if !strings.Contains(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't contain the labelled conflict:\n%s", result.Body)
+	}
+}
+
+func TestPerformMergeConflictMarkerSize(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	config := MergeConfig{ConflictStyle: Diff3ConflictStyle, ConflictMarkerSize: 9}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	expected := "<<<<<<<<< ../data/conflict1_yours\n" +
+		"  if (y == x + 17) {\n" +
+		"||||||||| ../data/conflict1_base\n" +
+		"  if (y == x + 19) {\n" +
+		"=========\n" +
+		"  if (z == x + 19) {\n" +
+		">>>>>>>>> ../data/conflict1_theirs\n"
+	if !strings.Contains(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't contain the expected conflict:\n%s", result.Body)
+	}
+}
+
+func TestPerformMergeSortedLists(t *testing.T) {
+	yours, base, theirs, triples, conflictsExist := performTestDiff3(
+		t, "sorted_list_yours", "sorted_list_base", "sorted_list_theirs")
+	if !conflictsExist {
+		t.Fatalf("Expected conflicts before resolving sorted lists")
+	}
+	config := MergeConfig{MergeSortedLists: true, SortedListKeyTrim: `,"`}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	if result.NumConflicts != 0 {
+		t.Errorf("Expected no conflicts, not %d:\n%s", result.NumConflicts, result.Body)
+	}
+	if len(result.Resolutions) != 2 {
+		t.Errorf("Expected 2 resolutions, not %d", len(result.Resolutions))
+	}
+	for _, expected := range []string{
+		"#include \"net/http.h\"\n#include \"net/tcp.h\"\n#include \"util/files.h\"\n",
+		"        \"//net:http\",\n        \"//net:tcp\",\n        \"//util:files\",\n",
+	} {
+		if !strings.Contains(string(result.Body), expected) {
+			t.Errorf("Merged file doesn't contain:\n%s\nMerged file:\n%s", expected, result.Body)
+		}
+	}
+}
+
+// A line deleted by one side and modified by the other (keeping its key) is
+// a conflict, not a deletion.
+func TestPerformMergeSortedListsDeleteVsModify(t *testing.T) {
+	for _, names := range [][2]string{
+		{"sorted_list_deleted", "sorted_list_requoted"},
+		{"sorted_list_requoted", "sorted_list_deleted"},
+	} {
+		yours, base, theirs, triples, _ := performTestDiff3(
+			t, names[0], "sorted_list_base", names[1])
+		config := MergeConfig{MergeSortedLists: true, SortedListKeyTrim: `,"'`}
+		result := PerformMerge(yours, base, theirs, triples, config)
+		if result.NumConflicts != 1 {
+			t.Errorf("Expected 1 conflict merging %v, not %d:\n%s",
+				names, result.NumConflicts, result.Body)
+		}
+		if !strings.Contains(string(result.Body), "'//net:socket',") {
+			t.Errorf("Merging %v lost the modified line:\n%s", names, result.Body)
+		}
+	}
+}
+
+func TestPerformMergeIntraLine(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	config := MergeConfig{MergeIntraLine: true, MinIntraLineTokenDistance: 1}
+	result := PerformMerge(yours, base, theirs, triples, config)
+	if result.NumConflicts != 0 {
+		t.Errorf("Expected no conflicts, not %d:\n%s", result.NumConflicts, result.Body)
+	}
+	if len(result.Resolutions) != 1 || result.Resolutions[0].Kind != IntraLineResolution {
+		t.Errorf("Expected 1 intra-line resolution, not %v", result.Resolutions)
+	}
+	expected := "func F(x, y int) int {\n  if (z == x + 17) {\n    return 7\n"
+	if !strings.Contains(string(result.Body), expected) {
+		t.Errorf("Merged file doesn't contain the merged line:\n%s", result.Body)
+	}
+}
+
+func TestMergeIntraLineChanges(t *testing.T) {
+	for _, tc := range []struct {
+		base, yours, theirs string
+		distance            int
+		expected            string
+		ok                  bool
+	}{
+		{"a = b + c;", "a = x + c;", "a = b + y;", 1, "a = x + y;", true},
+		{"a = b + c;", "a = x + c;", "a = b + y;", 4, "", false},
+		{"a = b + c;", "a = x + c;", "a = z + c;", 1, "", false},
+		{"a = b + c;", "a = x + c;", "a = x + c;", 1, "a = x + c;", true},
+		{"f(a, b)", "f(a, b, c)", "g(a, b)", 1, "g(a, b, c)", true},
+	} {
+		merged, ok := MergeIntraLineChanges(
+			[]byte(tc.base), []byte(tc.yours), []byte(tc.theirs), tc.distance)
+		if ok != tc.ok || (ok && string(merged) != tc.expected) {
+			t.Errorf("MergeIntraLineChanges(%q, %q, %q, %d) = %q, %v; expected %q, %v",
+				tc.base, tc.yours, tc.theirs, tc.distance, merged, ok, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestPerformMergePropagateRenames(t *testing.T) {
+	yours, base, theirs, triples, _ := performTestDiff3(
+		t, "rename_yours", "rename_base", "rename_theirs")
+	result := PerformMerge(yours, base, theirs, triples, MergeConfig{})
+	if !strings.Contains(string(result.Body), "if (count >= kMaxCount)") {
+		t.Errorf("Renames should only be propagated when enabled:\n%s", result.Body)
+	}
+	result = PerformMerge(yours, base, theirs, triples, MergeConfig{PropagateRenames: true})
+	if result.NumConflicts != 0 {
+		t.Errorf("Expected no conflicts, not %d:\n%s", result.NumConflicts, result.Body)
+	}
+	if !strings.Contains(string(result.Body), "if (num_matches >= kMaxCount)") {
+		t.Errorf("Rename not propagated:\n%s", result.Body)
+	}
+	if len(result.RenameRewrites) != 1 {
+		t.Fatalf("Expected 1 rewrite, not %v", result.RenameRewrites)
+	}
+	rewrite := result.RenameRewrites[0]
+	if rewrite.TheirsIndex != 3 || rewrite.OutputIndex != 3 ||
+		len(rewrite.Renames) != 1 || rewrite.Renames[0].Old != "count" ||
+		rewrite.Renames[0].New != "num_matches" {
+		t.Errorf("Unexpected rewrite: %s", rewrite)
+	}
+}
+
+func TestPerformMergeIndentation(t *testing.T) {
+	expected := "void Process(const vector<Item>& items) {\n" +
+		"  if (!items.empty()) {\n" +
+		"    for (const auto& item : items) {\n" +
+		"      Validate(item, /*strict=*/true);\n" +
+		"      Log(item);\n" +
+		"      Store(item);\n" +
+		"    }\n" +
+		"  }\n" +
+		"  Flush();\n" +
+		"}\n"
+	for _, names := range [][2]string{
+		{"indent_yours", "indent_theirs"},
+		{"indent_theirs", "indent_yours"},
+	} {
+		yours, base, theirs, triples, _ := performTestDiff3(t, names[0], "indent_base", names[1])
+		result := PerformMerge(yours, base, theirs, triples, MergeConfig{MergeIndentation: true})
+		if result.NumConflicts != 0 || string(result.Body) != expected {
+			t.Errorf("Unexpected merge (%d conflicts):\n%s", result.NumConflicts, result.Body)
+		}
+		if len(result.Resolutions) != 1 || result.Resolutions[0].Kind != IndentationResolution {
+			t.Errorf("Expected 1 indentation resolution, not %v", result.Resolutions)
+		}
+	}
+}
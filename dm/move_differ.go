@@ -15,6 +15,10 @@ type MoveCandidate2 struct {
 	originalBGapRange    FileRange
 	lcsData              *lcsOfFileRangePair
 	moveScore            float64
+
+	// The gaps are in different files (see FindCrossFileMoves), so there is no
+	// distance between them.
+	crossFile bool
 }
 
 func (p *MoveCandidate2) AExtent() int {
@@ -52,31 +56,34 @@ func (p *MoveCandidate2) SetScore() {
 
 	glog.V(1).Infof("MoveCandidate2.SetScore: extentScore=%v", extentScore)
 
-	var distance float64
-	if p.aGapIndex < p.bGapIndex {
-		// limitsInB are above originalBGapRange.
-		// Least distance
-		hi, lo := p.lcsData.limitsInB.Index1, p.originalBGapRange.BeyondIndex()
-		d1 := hi - lo
-		// Greatest distance
-		hi, lo = p.lcsData.limitsInB.Index2, p.originalBGapRange.FirstIndex()
-		d2 := hi - lo
-		distance = float64(d1+d2) / 2
-	} else /* p.aGapIndex > p.bGapIndex */ {
-		// limitsInB are below originalBGapRange.
-		// Least distance
-		lo, hi := p.lcsData.limitsInB.Index2, p.originalBGapRange.FirstIndex()
-		d1 := hi - lo
-		// Greatest distance
-		lo, hi = p.lcsData.limitsInB.Index1, p.originalBGapRange.BeyondIndex()
-		d2 := hi - lo
-		distance = float64(d1+d2) / 2
-	}
+	distanceScore := 1.0
+	if !p.crossFile {
+		var distance float64
+		if p.aGapIndex < p.bGapIndex {
+			// limitsInB are above originalBGapRange.
+			// Least distance
+			hi, lo := p.lcsData.limitsInB.Index1, p.originalBGapRange.BeyondIndex()
+			d1 := hi - lo
+			// Greatest distance
+			hi, lo = p.lcsData.limitsInB.Index2, p.originalBGapRange.FirstIndex()
+			d2 := hi - lo
+			distance = float64(d1+d2) / 2
+		} else /* p.aGapIndex > p.bGapIndex */ {
+			// limitsInB are below originalBGapRange.
+			// Least distance
+			lo, hi := p.lcsData.limitsInB.Index2, p.originalBGapRange.FirstIndex()
+			d1 := hi - lo
+			// Greatest distance
+			lo, hi = p.lcsData.limitsInB.Index1, p.originalBGapRange.BeyondIndex()
+			d2 := hi - lo
+			distance = float64(d1+d2) / 2
+		}
 
-	normalizedDistance := distance * 100 / float64(p.originalBGapRange.File().LineCount())
-	distanceScore := distanceCurve.Compute(-normalizedDistance)
+		normalizedDistance := distance * 100 / float64(p.originalBGapRange.File().LineCount())
+		distanceScore = distanceCurve.Compute(-normalizedDistance)
 
-	glog.V(1).Infof("MoveCandidate2.SetScore: distance=%v,  normalizedDistance=%v,  distanceScore=%v", distance, normalizedDistance, distanceScore)
+		glog.V(1).Infof("MoveCandidate2.SetScore: distance=%v,  normalizedDistance=%v,  distanceScore=%v", distance, normalizedDistance, distanceScore)
+	}
 
 	p.moveScore = float64(p.lcsData.lcsScore) * extentScore * distanceScore
 	glog.Infof("MoveCandidate2.SetScore gap %d in A vs. gap %d in B, moveScore = %v",
@@ -0,0 +1,544 @@
+package dm
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// A three-way merge in which moves are recognized (see README problem #4):
+// if one side (yours or theirs) moved a block of lines, and the other side
+// edited lines within that block (without moving it), the edits are
+// transferred to the block at its new location, and the block is restored
+// to its base state at its old location in the other side. The ordinary
+// merge of the rewritten files then sees only the move (a deletion and an
+// insertion) in one side, and nothing in the other side that conflicts
+// with it.
+//
+// The moved blocks are found from the output of PerformDiff2: the exactly
+// matching lines that are not part of the longest ordered chain of matches
+// (see BaseAnchoredChanges) are out of order, i.e. moved.
+//
+// Which of several blocks is considered moved is a matter of alignment; e.g.
+// if yours swaps two adjacent blocks, the shorter one is treated as moved, and
+// if theirs edits the longer one, the edits don't fall within a moved block.
+// So, if the merge still has conflicts and one side only rearranged the
+// blocks of base (see findRearrangedBlocks), the merge is instead produced by
+// taking the other side's version of each block, in the rearranged order.
+
+// A block of base lines that was moved in a changed file (yours or theirs).
+type MovedBlock struct {
+	// The lines in base.
+	BaseStart, BaseBeyond int
+
+	// The lines in the changed file (the move destination).
+	Start, Beyond int
+
+	// The MoveId assigned by PerformDiff2, if any.
+	MoveId int
+}
+
+// Returns the blocks of base that were moved in the changed file, given the
+// BlockPairs produced by PerformDiff2(base, changed). A block may include
+// lines edited by the changed file between moved runs of matching lines.
+func FindMovedBlocks(base, changed *File, pairs BlockPairs) (blocks []*MovedBlock) {
+	runs := exactMatchRuns(base, changed, pairs)
+	anchors := longestOrderedChain(runs)
+	isAnchor := make(map[*BlockPair]bool)
+	for _, anchor := range anchors {
+		isAnchor[anchor] = true
+	}
+	// Is there an anchor between the lines of the two runs, in either file?
+	anchorBetween := func(prev, next *BlockPair) bool {
+		for _, anchor := range anchors {
+			if (prev.ABeyond() <= anchor.AIndex && anchor.AIndex < next.AIndex) ||
+				(prev.BBeyond() <= anchor.BIndex && anchor.BIndex < next.BIndex) {
+				return true
+			}
+		}
+		return false
+	}
+	var block *MovedBlock
+	var prev *BlockPair
+	for _, run := range runs {
+		if isAnchor[run] {
+			continue
+		}
+		if block != nil && run.AIndex >= prev.ABeyond() &&
+			run.BIndex >= prev.BBeyond() && !anchorBetween(prev, run) {
+			// Same block, possibly with edits between the runs.
+			block.BaseBeyond = run.ABeyond()
+			block.Beyond = run.BBeyond()
+		} else {
+			block = &MovedBlock{
+				BaseStart:  run.AIndex,
+				BaseBeyond: run.ABeyond(),
+				Start:      run.BIndex,
+				Beyond:     run.BBeyond(),
+			}
+			blocks = append(blocks, block)
+		}
+		if block.MoveId == 0 {
+			block.MoveId = run.MoveId
+		}
+		prev = run
+	}
+	// PerformDiff2 may have matched some of the lines at the ends of a moved
+	// block with other (typically common) lines, so extend the blocks while
+	// the adjacent lines are the same.
+	for _, block := range blocks {
+		for block.BaseStart > 0 && block.Start > 0 && bytes.Equal(
+			base.GetLineBytes(block.BaseStart-1), changed.GetLineBytes(block.Start-1)) {
+			block.BaseStart--
+			block.Start--
+		}
+		for block.BaseBeyond < base.LineCount() && block.Beyond < changed.LineCount() &&
+			bytes.Equal(base.GetLineBytes(block.BaseBeyond), changed.GetLineBytes(block.Beyond)) {
+			block.BaseBeyond++
+			block.Beyond++
+		}
+	}
+	// Ignore blocks that consist only of common lines (e.g. closing braces),
+	// which are as likely to be the result of an ambiguous alignment as of a
+	// move, and blocks that overlap others after extension.
+	result := blocks[:0]
+	for n, block := range blocks {
+		if n > 0 && (blocks[n-1].BaseBeyond > block.BaseStart) {
+			continue
+		}
+		for i := block.BaseStart; i < block.BaseBeyond; i++ {
+			if !base.Lines[i].ProbablyCommon {
+				result = append(result, block)
+				break
+			}
+		}
+	}
+	glog.Infof("FindMovedBlocks found %d moved blocks", len(result))
+	return result
+}
+
+// Records the transfer of the edits made by one side to a block which the
+// other side moved.
+type MoveTransfer struct {
+	Block *MovedBlock
+
+	// Did yours move the block (and theirs edit it)? If false, theirs moved it.
+	MovedByYours bool
+
+	// The lines of the rewritten file of the side that moved the block which
+	// contain the block, with the edits applied.
+	Start, Beyond int
+}
+
+func (p *MoveTransfer) moverName() string {
+	if p.MovedByYours {
+		return "yours"
+	}
+	return "theirs"
+}
+
+// A replacement of the lines [start, beyond) of a file with new lines.
+type lineReplacement struct {
+	start, beyond int
+	lines         [][]byte
+	transfer      *MoveTransfer
+}
+
+// Given the changes made by a file relative to base (see BaseAnchoredChanges),
+// returns the lines of the file that correspond to the base lines [start,
+// beyond), if all of the changes that overlap those base lines are within
+// them, along with whether there are any such changes.
+func findEditedBlock(changes BlockPairs, start, beyond int) (
+	editedStart, editedBeyond int, hasEdits, ok bool) {
+	// The difference between the line numbers in the edited file and in base.
+	delta := 0
+	for _, change := range changes {
+		if change.ABeyond() <= start {
+			// Before the block.
+			delta = change.BBeyond() - change.ABeyond()
+			continue
+		}
+		if change.AIndex >= beyond {
+			// After the block.
+			break
+		}
+		if change.AIndex < start || change.ABeyond() > beyond {
+			// The change straddles the boundary of the block.
+			return 0, 0, false, false
+		}
+		if !hasEdits {
+			editedStart = start + delta
+			hasEdits = true
+		}
+		delta = change.BBeyond() - change.ABeyond()
+	}
+	if !hasEdits {
+		editedStart = start + delta
+	}
+	return editedStart, beyond + delta, hasEdits, true
+}
+
+// Merges the lines of a block which was moved, and perhaps edited, by the
+// mover, and edited in place by the editor.
+func mergeMovedBlock(moved, base, edited []byte, dCfg DifferencerConfig,
+	mCfg MergeConfig) (lines [][]byte, ok bool) {
+	if bytes.Equal(moved, base) {
+		return splitLines(edited), true
+	}
+	mFile, _ := BuildFile("moved", moved)
+	bFile, _ := BuildFile("base", base)
+	eFile, _ := BuildFile("edited", edited)
+	triples, _ := PerformDiff3(mFile, bFile, eFile,
+		PerformDiff2(bFile, mFile, dCfg), PerformDiff2(bFile, eFile, dCfg), dCfg)
+	result := PerformMerge(mFile, bFile, eFile, triples, mCfg)
+	if result.NumConflicts > 0 {
+		return nil, false
+	}
+	return splitLines(result.Body), true
+}
+
+func splitLines(body []byte) (lines [][]byte) {
+	for len(body) > 0 {
+		n := bytes.IndexByte(body, '\n') + 1
+		if n == 0 {
+			n = len(body)
+		}
+		lines = append(lines, body[:n])
+		body = body[n:]
+	}
+	return
+}
+
+func joinFileLines(f *File, start, beyond int) []byte {
+	if start >= beyond {
+		return nil
+	}
+	return f.Body[f.Lines[start].Start : f.Lines[beyond-1].Start+f.Lines[beyond-1].Length]
+}
+
+// Finds the blocks moved by the mover which the editor edited in place, and
+// computes the replacements needed in each file to transfer those edits.
+func findMoveTransfers(mover, base, editor *File, b2mPairs, b2ePairs BlockPairs,
+	movedByYours bool, dCfg DifferencerConfig, mCfg MergeConfig) (
+	moverReplacements, editorReplacements []*lineReplacement) {
+	_, eChanges := BaseAnchoredChanges(base, editor, b2ePairs)
+	for _, block := range FindMovedBlocks(base, mover, b2mPairs) {
+		eStart, eBeyond, hasEdits, ok := findEditedBlock(
+			eChanges, block.BaseStart, block.BaseBeyond)
+		if !ok || !hasEdits || eStart >= eBeyond {
+			// Not edited, or not just edited within the block (e.g. deleted, or
+			// moved elsewhere by the editor too).
+			continue
+		}
+		lines, ok := mergeMovedBlock(
+			joinFileLines(mover, block.Start, block.Beyond),
+			joinFileLines(base, block.BaseStart, block.BaseBeyond),
+			joinFileLines(editor, eStart, eBeyond), dCfg, mCfg)
+		if !ok {
+			glog.Infof("Unable to merge the edits to base lines [%d, %d) with their move",
+				block.BaseStart, block.BaseBeyond)
+			continue
+		}
+		transfer := &MoveTransfer{Block: block, MovedByYours: movedByYours}
+		moverReplacements = append(moverReplacements, &lineReplacement{
+			start:    block.Start,
+			beyond:   block.Beyond,
+			lines:    lines,
+			transfer: transfer,
+		})
+		editorReplacements = append(editorReplacements, &lineReplacement{
+			start:  eStart,
+			beyond: eBeyond,
+			lines:  splitLines(joinFileLines(base, block.BaseStart, block.BaseBeyond)),
+		})
+	}
+	return
+}
+
+// Applies the (non-overlapping) replacements to the file, returning the new
+// file, and setting the Start and Beyond of the transfers.
+func applyLineReplacements(f *File, replacements []*lineReplacement) *File {
+	if len(replacements) == 0 {
+		return f
+	}
+	sort.Slice(replacements, func(i, j int) bool {
+		return replacements[i].start < replacements[j].start
+	})
+	var buf bytes.Buffer
+	next, numLines := 0, 0
+	for _, r := range replacements {
+		buf.Write(joinFileLines(f, next, r.start))
+		numLines += r.start - next
+		if r.transfer != nil {
+			r.transfer.Start = numLines
+			r.transfer.Beyond = numLines + len(r.lines)
+		}
+		for _, line := range r.lines {
+			buf.Write(line)
+		}
+		numLines += len(r.lines)
+		next = r.beyond
+	}
+	buf.Write(joinFileLines(f, next, f.LineCount()))
+	result, _ := BuildFile(f.Name, buf.Bytes())
+	result.Label = f.Label
+	return result
+}
+
+// Drops those replacements (along with their counterparts in the other
+// file) which overlap another replacement in either file.
+func dropOverlappingReplacements(yReplacements, tReplacements []*lineReplacement) (
+	[]*lineReplacement, []*lineReplacement) {
+	overlaps := func(s []*lineReplacement, n int) bool {
+		for m := range s {
+			if m != n && s[m].start < s[n].beyond && s[n].start < s[m].beyond {
+				return true
+			}
+		}
+		return false
+	}
+	var yResult, tResult []*lineReplacement
+	for n := range yReplacements {
+		if overlaps(yReplacements, n) || overlaps(tReplacements, n) {
+			glog.Infof("Ignoring overlapping moved block, yours lines [%d, %d)",
+				yReplacements[n].start, yReplacements[n].beyond)
+			continue
+		}
+		yResult = append(yResult, yReplacements[n])
+		tResult = append(tResult, tReplacements[n])
+	}
+	return yResult, tResult
+}
+
+// Performs a three-way merge of yours and theirs, as for PerformDiff3 and
+// PerformMerge, but first transferring edits made by one side to blocks
+// which the other side moved. b2yPairs and b2tPairs are the output of
+// PerformDiff2(base, yours) and PerformDiff2(base, theirs).
+func PerformMoveAwareMerge(yours, base, theirs *File, b2yPairs, b2tPairs BlockPairs,
+	dCfg DifferencerConfig, mCfg MergeConfig) *MergeResult {
+	result := performMoveTransferMerge(yours, base, theirs, b2yPairs, b2tPairs, dCfg, mCfg)
+	if result.NumConflicts == 0 {
+		return result
+	}
+	if blocks := findRearrangedBlocks(base, yours); blocks != nil {
+		if rearranged := mergeRearrangedBlocks(base, theirs, blocks, true); rearranged != nil {
+			return rearranged
+		}
+	}
+	if blocks := findRearrangedBlocks(base, theirs); blocks != nil {
+		if rearranged := mergeRearrangedBlocks(base, yours, blocks, false); rearranged != nil {
+			return rearranged
+		}
+	}
+	return result
+}
+
+func performMoveTransferMerge(yours, base, theirs *File, b2yPairs, b2tPairs BlockPairs,
+	dCfg DifferencerConfig, mCfg MergeConfig) *MergeResult {
+	yByY, tByY := findMoveTransfers(yours, base, theirs, b2yPairs, b2tPairs, true, dCfg, mCfg)
+	tByT, yByT := findMoveTransfers(theirs, base, yours, b2tPairs, b2yPairs, false, dCfg, mCfg)
+	// Pair up the replacements so that conflicting ones can be dropped together.
+	yReplacements := append(yByY, yByT...)
+	tReplacements := append(tByY, tByT...)
+	yReplacements, tReplacements = dropOverlappingReplacements(yReplacements, tReplacements)
+	if len(yReplacements) == 0 {
+		triples, _ := PerformDiff3(yours, base, theirs, b2yPairs, b2tPairs, dCfg)
+		return PerformMerge(yours, base, theirs, triples, mCfg)
+	}
+	var transfers []*MoveTransfer
+	for n := range yReplacements {
+		if t := yReplacements[n].transfer; t != nil {
+			transfers = append(transfers, t)
+		} else {
+			transfers = append(transfers, tReplacements[n].transfer)
+		}
+	}
+	glog.Infof("PerformMoveAwareMerge transferring edits to %d moved blocks", len(transfers))
+
+	newYours := applyLineReplacements(yours, yReplacements)
+	newTheirs := applyLineReplacements(theirs, tReplacements)
+	b2yPairs = PerformDiff2(base, newYours, dCfg)
+	b2tPairs = PerformDiff2(base, newTheirs, dCfg)
+	triples, _ := PerformDiff3(newYours, base, newTheirs, b2yPairs, b2tPairs, dCfg)
+	state := newMergeState(newYours, base, newTheirs, mCfg)
+	state.mergeTriples(triples)
+
+	// Report where the moved blocks ended up in the merged file.
+	for _, transfer := range transfers {
+		outputLines := state.theirsOutput
+		if transfer.MovedByYours {
+			outputLines = state.yoursOutput
+		}
+		outputStart, ok1 := outputLines[transfer.Start]
+		outputLast, ok2 := outputLines[transfer.Beyond-1]
+		if !ok1 || !ok2 || outputLast-outputStart != transfer.Beyond-transfer.Start-1 {
+			// Not (entirely) output, e.g. the block is in a conflict.
+			continue
+		}
+		state.result.Resolutions = append(state.result.Resolutions, &MergeResolution{
+			Kind:         MovedBlockResolution,
+			Move:         transfer,
+			OutputStart:  outputStart,
+			OutputBeyond: outputLast + 1,
+		})
+	}
+	sort.SliceStable(state.result.Resolutions, func(i, j int) bool {
+		return state.result.Resolutions[i].OutputStart < state.result.Resolutions[j].OutputStart
+	})
+	return state.result
+}
+
+// Returns the blocks of base in the order in which they appear in the mover,
+// if the mover only rearranged the lines of base (i.e. each line of base
+// appears exactly once in the mover, and there are no other lines), else nil.
+// Each block is the longest run of the (not yet used) lines of base that
+// matches the mover at the end of the previous block.
+func findRearrangedBlocks(base, mover *File) (blocks []*MovedBlock) {
+	if base.LineCount() != mover.LineCount() {
+		return nil
+	}
+	positions := base.GetFullRange().HashPositions()
+	used := make([]bool, base.LineCount())
+	for start := 0; start < mover.LineCount(); {
+		bestStart, bestLength := -1, 0
+		for _, baseStart := range positions[mover.GetHashOfLine(start)] {
+			n := 0
+			for baseStart+n < base.LineCount() && start+n < mover.LineCount() &&
+				!used[baseStart+n] &&
+				bytes.Equal(base.GetLineBytes(baseStart+n), mover.GetLineBytes(start+n)) {
+				n++
+			}
+			if n > bestLength {
+				bestStart, bestLength = baseStart, n
+			}
+		}
+		if bestLength == 0 {
+			return nil
+		}
+		for n := 0; n < bestLength; n++ {
+			used[bestStart+n] = true
+		}
+		blocks = append(blocks, &MovedBlock{
+			BaseStart:  bestStart,
+			BaseBeyond: bestStart + bestLength,
+			Start:      start,
+			Beyond:     start + bestLength,
+		})
+		start += bestLength
+	}
+	if len(blocks) < 2 {
+		// Nothing moved.
+		return nil
+	}
+	return blocks
+}
+
+// The maximum size of the table used by alignLinesExactly.
+const maxExactAlignmentCells = 1 << 22
+
+// Returns, for each line of base, the index of the identical line of the
+// editor with which it is aligned, or -1. The alignment is the common prefix
+// and suffix, plus the longest common subsequence of the lines between them
+// (i.e. as diff(1) would align them), which is preferable here to the
+// alignment produced by PerformDiff2, as the lines of the editor are only
+// compared with those of the same blocks of base. Returns nil if the files
+// are too large.
+func alignLinesExactly(base, editor *File) []int {
+	editorIndexOf := make([]int, base.LineCount())
+	for n := range editorIndexOf {
+		editorIndexOf[n] = -1
+	}
+	equal := func(b, e int) bool {
+		return base.GetHashOfLine(b) == editor.GetHashOfLine(e) &&
+			bytes.Equal(base.GetLineBytes(b), editor.GetLineBytes(e))
+	}
+	prefix := 0
+	for prefix < base.LineCount() && prefix < editor.LineCount() && equal(prefix, prefix) {
+		editorIndexOf[prefix] = prefix
+		prefix++
+	}
+	bBeyond, eBeyond := base.LineCount(), editor.LineCount()
+	for bBeyond > prefix && eBeyond > prefix && equal(bBeyond-1, eBeyond-1) {
+		bBeyond--
+		eBeyond--
+		editorIndexOf[bBeyond] = eBeyond
+	}
+	bLength, eLength := bBeyond-prefix, eBeyond-prefix
+	if (bLength+1)*(eLength+1) > maxExactAlignmentCells {
+		return nil
+	}
+	lcs, _ := WeightedLCS(bLength, eLength, func(b, e int) float32 {
+		if equal(prefix+b, prefix+e) {
+			return 1
+		}
+		return 0
+	})
+	for _, ip := range lcs {
+		editorIndexOf[prefix+ip.Index1] = prefix + ip.Index2
+	}
+	return editorIndexOf
+}
+
+// Merges the edits made by the editor into the blocks (from
+// findRearrangedBlocks) of the file which rearranged base, returning nil if
+// any of the edits spans the boundary between two blocks (in which case it
+// isn't clear where the edit belongs).
+func mergeRearrangedBlocks(base, editor *File, blocks []*MovedBlock,
+	movedByYours bool) *MergeResult {
+	editorIndexOf := alignLinesExactly(base, editor)
+	if editorIndexOf == nil {
+		return nil
+	}
+	// Returns the index of the line of the editor corresponding to the
+	// boundary in base just before line n.
+	boundary := func(n int) (int, bool) {
+		if n == 0 {
+			return 0, true
+		} else if n == base.LineCount() {
+			return editor.LineCount(), true
+		}
+		before, after := editorIndexOf[n-1], editorIndexOf[n]
+		if before >= 0 && after >= 0 {
+			// Lines inserted between them could belong to either block.
+			return after, after == before+1
+		} else if before >= 0 {
+			return before + 1, true
+		} else if after >= 0 {
+			return after, true
+		}
+		return 0, false
+	}
+	result := &MergeResult{}
+	var buf bytes.Buffer
+	numLines := 0
+	for _, block := range blocks {
+		eStart, ok1 := boundary(block.BaseStart)
+		eBeyond, ok2 := boundary(block.BaseBeyond)
+		if !ok1 || !ok2 {
+			glog.Infof("Edits to base lines around [%d, %d) span the boundary of a moved block",
+				block.BaseStart, block.BaseBeyond)
+			return nil
+		}
+		edited := joinFileLines(editor, eStart, eBeyond)
+		buf.Write(edited)
+		if !bytes.Equal(edited, joinFileLines(base, block.BaseStart, block.BaseBeyond)) {
+			transfer := &MoveTransfer{
+				Block:        block,
+				MovedByYours: movedByYours,
+				Start:        numLines,
+				Beyond:       numLines + eBeyond - eStart,
+			}
+			result.Resolutions = append(result.Resolutions, &MergeResolution{
+				Kind:         MovedBlockResolution,
+				Move:         transfer,
+				OutputStart:  transfer.Start,
+				OutputBeyond: transfer.Beyond,
+			})
+		}
+		numLines += eBeyond - eStart
+	}
+	glog.Infof("mergeRearrangedBlocks merged the edits into %d rearranged blocks", len(blocks))
+	result.Body = buf.Bytes()
+	return result
+}
@@ -0,0 +1,78 @@
+package dm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPerformMoveAwareMerge(t *testing.T) {
+	cfg := DefaultDifferencerConfig()
+	for _, names := range [][2]string{
+		{"swap_1324", "swap_1234_edit_13"},
+		{"swap_1234_edit_13", "swap_1324"},
+	} {
+		yours := readTestFile(t, names[0])
+		base := readTestFile(t, "swap_1234")
+		theirs := readTestFile(t, names[1])
+		result := PerformMoveAwareMerge(yours, base, theirs,
+			PerformDiff2(base, yours, cfg), PerformDiff2(base, theirs, cfg),
+			cfg, MergeConfig{MergeMoves: true})
+		if result.NumConflicts != 0 {
+			t.Errorf("Expected no conflicts, not %d:\n%s", result.NumConflicts, result.Body)
+		}
+		expected := "void func1() {\n  x += 11\n}\n\nvoid func3() {\n  y += 33\n}\n\n" +
+			"void func2() {\n  x += 2\n}\n\nvoid func4() {\n  y += 4\n}\n"
+		if string(result.Body) != expected {
+			t.Errorf("Unexpected merge of %v:\n%s", names, result.Body)
+		}
+		if len(result.Resolutions) != 1 || result.Resolutions[0].Kind != MovedBlockResolution {
+			t.Errorf("Expected 1 move resolution, not %v", result.Resolutions)
+		} else if !strings.Contains(result.Resolutions[0].String(), "auto-resolved move") {
+			t.Errorf("Unexpected resolution summary: %s", result.Resolutions[0])
+		}
+	}
+}
+
+// Yours swaps the two loops of base, and theirs rewrites one of them (and the
+// final return), so the longer loop is aligned as if it hadn't moved.
+func TestPerformMoveAwareMergeOfSwappedLoops(t *testing.T) {
+	cfg := DefaultDifferencerConfig()
+	yours := readTestFile(t, "swap_loops_change_1")
+	base := readTestFile(t, "swap_loops_change_3")
+	theirs := readTestFile(t, "swap_loops_change_2")
+	result := PerformMoveAwareMerge(yours, base, theirs,
+		PerformDiff2(base, yours, cfg), PerformDiff2(base, theirs, cfg),
+		cfg, MergeConfig{MergeMoves: true})
+	if result.NumConflicts != 0 {
+		t.Fatalf("Expected no conflicts, not %d:\n%s", result.NumConflicts, result.Body)
+	}
+	expected := `// Adapted from some C++ code.
+
+bool FeatureController::FeatureEnabled(
+    const ConfigData& config_data, const string& needle_name) const {
+  if (config_data.good_all_names()) {
+    return true;
+  }
+
+  for (const auto& name : config_data.good_name()) {
+    if (needle_name == name) {
+      return true;
+    }
+  }
+
+  for (const auto& name : config_data.bad_name()) {
+    if (needle_name == name) {
+      return false;
+    }
+  }
+  return false;
+}
+
+`
+	if string(result.Body) != expected {
+		t.Errorf("Unexpected merge:\n%s", result.Body)
+	}
+	if len(result.Resolutions) == 0 || result.Resolutions[0].Kind != MovedBlockResolution {
+		t.Errorf("Expected move resolutions, not %v", result.Resolutions)
+	}
+}
@@ -0,0 +1,230 @@
+package dm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parses unified diffs, as produced by FormatUnifiedDiff, "diff -u" and
+// "git diff", into FilePatches. Lines preceding a "--- " header (e.g. "diff
+// --git ..." and "index ..." lines) are ignored.
+
+// A line of a hunk: Op is ' ' for a context line, '-' for a line removed
+// from the old file, or '+' for a line added in the new file. Text includes
+// the line's newline, if it has one.
+type PatchLine struct {
+	Op   byte
+	Text []byte
+}
+
+type PatchHunk struct {
+	// The zero-based index of the first line of the hunk in the old and new
+	// files (as given in the hunk header), and the number of lines of each.
+	// For an empty range, the start is that of the line after which the lines
+	// are to be inserted (or were removed).
+	OldStart, OldLength int
+	NewStart, NewLength int
+
+	Lines []PatchLine
+}
+
+// Returns the hunk header, e.g. "@@ -3,4 +3,5 @@".
+func (p *PatchHunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@",
+		formatUnifiedRange(p.OldStart, p.OldStart+p.OldLength),
+		formatUnifiedRange(p.NewStart, p.NewStart+p.NewLength))
+}
+
+// Returns the lines of the old file in the hunk (the context and removed
+// lines).
+func (p *PatchHunk) OldLines() (lines [][]byte) {
+	for _, line := range p.Lines {
+		if line.Op != '+' {
+			lines = append(lines, line.Text)
+		}
+	}
+	return
+}
+
+// Returns the lines of the new file in the hunk (the context and added
+// lines).
+func (p *PatchHunk) NewLines() (lines [][]byte) {
+	for _, line := range p.Lines {
+		if line.Op != '-' {
+			lines = append(lines, line.Text)
+		}
+	}
+	return
+}
+
+// The changes to a single file.
+type FilePatch struct {
+	// The names from the "---" and "+++" headers, without any timestamp.
+	OldName, NewName string
+
+	Hunks []*PatchHunk
+}
+
+// Parses the start and length of a range in a hunk header, e.g. "3,4" or "3"
+// (a length of 1), converting the start to a zero-based index.
+func parseUnifiedRange(s string) (start, length int, err error) {
+	length = 1
+	if comma := strings.IndexByte(s, ','); comma >= 0 {
+		if length, err = strconv.Atoi(s[comma+1:]); err != nil {
+			return
+		}
+		s = s[:comma]
+	}
+	if start, err = strconv.Atoi(s); err != nil {
+		return
+	}
+	if length > 0 {
+		start--
+	}
+	if start < 0 || length < 0 {
+		err = fmt.Errorf("invalid range")
+	}
+	return
+}
+
+// Parses a hunk header of the form "@@ -3,4 +3,5 @@ optional section name".
+func parseHunkHeader(line string) (*PatchHunk, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "@@" || fields[3] != "@@" ||
+		!strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return nil, fmt.Errorf("invalid hunk header: %q", line)
+	}
+	hunk := &PatchHunk{}
+	var err error
+	if hunk.OldStart, hunk.OldLength, err = parseUnifiedRange(fields[1][1:]); err != nil {
+		return nil, fmt.Errorf("invalid hunk header: %q", line)
+	}
+	if hunk.NewStart, hunk.NewLength, err = parseUnifiedRange(fields[2][1:]); err != nil {
+		return nil, fmt.Errorf("invalid hunk header: %q", line)
+	}
+	return hunk, nil
+}
+
+// Returns the file name from a "--- " or "+++ " header line, without the
+// timestamp (separated by a tab) that diff(1) appends.
+func patchHeaderName(line string) string {
+	name := strings.TrimRight(line[4:], "\r\n")
+	if tab := strings.IndexByte(name, '\t'); tab >= 0 {
+		name = name[:tab]
+	}
+	return name
+}
+
+// Parses the unified diff, which may contain the changes to several files.
+func ParseUnifiedDiff(r io.Reader) (patches []*FilePatch, err error) {
+	reader := bufio.NewReader(r)
+	var patch *FilePatch
+	var hunk *PatchHunk
+	oldRemaining, newRemaining := 0, 0
+	lineNumber := 0
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) == 0 && readErr != nil {
+			if readErr != io.EOF {
+				return nil, readErr
+			}
+			break
+		}
+		lineNumber++
+		fail := func(format string, a ...interface{}) error {
+			return fmt.Errorf("line %d: %s", lineNumber, fmt.Sprintf(format, a...))
+		}
+		if hunk != nil && (oldRemaining > 0 || newRemaining > 0) {
+			op := byte(' ')
+			if len(line) > 0 {
+				op = line[0]
+			}
+			text := line
+			if len(text) > 0 {
+				text = text[1:]
+			}
+			if op == '\n' || (op == '\r' && bytes.Equal(line, []byte("\r\n"))) {
+				// An empty context line, whose leading space was removed (e.g. by
+				// an editor or email client).
+				op, text = ' ', line
+			}
+			switch op {
+			case ' ':
+				oldRemaining--
+				newRemaining--
+			case '-':
+				oldRemaining--
+			case '+':
+				newRemaining--
+			case '\\':
+				// "\ No newline at end of file", which applies to the previous line.
+				if err := trimLastPatchLine(hunk); err != nil {
+					return nil, fail("%s", err)
+				}
+				continue
+			default:
+				return nil, fail("unexpected line in hunk: %q", line)
+			}
+			if oldRemaining < 0 || newRemaining < 0 {
+				return nil, fail("hunk has more lines than its header %s", hunk.Header())
+			}
+			hunk.Lines = append(hunk.Lines, PatchLine{Op: op, Text: text})
+			continue
+		}
+		s := string(line)
+		switch {
+		case strings.HasPrefix(s, "\\"):
+			if hunk == nil {
+				return nil, fail("unexpected line: %q", line)
+			}
+			if err := trimLastPatchLine(hunk); err != nil {
+				return nil, fail("%s", err)
+			}
+		case strings.HasPrefix(s, "--- "):
+			patch = &FilePatch{OldName: patchHeaderName(s)}
+			patches = append(patches, patch)
+			hunk = nil
+		case strings.HasPrefix(s, "+++ "):
+			if patch == nil || patch.NewName != "" || len(patch.Hunks) > 0 {
+				return nil, fail("\"+++\" header without \"---\" header")
+			}
+			patch.NewName = patchHeaderName(s)
+		case strings.HasPrefix(s, "@@ "):
+			if patch == nil || patch.NewName == "" {
+				return nil, fail("hunk without file headers")
+			}
+			if hunk, err = parseHunkHeader(s); err != nil {
+				return nil, fail("%s", err)
+			}
+			patch.Hunks = append(patch.Hunks, hunk)
+			oldRemaining, newRemaining = hunk.OldLength, hunk.NewLength
+		default:
+			// Ignore other lines, such as those of "git diff" headers, but only
+			// between hunks.
+			hunk = nil
+		}
+	}
+	if hunk != nil && (oldRemaining > 0 || newRemaining > 0) {
+		return nil, fmt.Errorf("line %d: hunk %s is truncated", lineNumber, hunk.Header())
+	}
+	return patches, nil
+}
+
+// Removes the newline from the last line of the hunk, as indicated by a
+// "\ No newline at end of file" line.
+func trimLastPatchLine(hunk *PatchHunk) error {
+	if len(hunk.Lines) == 0 {
+		return fmt.Errorf("\"\\\" line at start of hunk")
+	}
+	last := &hunk.Lines[len(hunk.Lines)-1]
+	last.Text = bytes.TrimSuffix(last.Text, []byte("\n"))
+	return nil
+}
+
+func ParseUnifiedDiffString(s string) ([]*FilePatch, error) {
+	return ParseUnifiedDiff(strings.NewReader(s))
+}
@@ -37,11 +37,24 @@ func PerformDiff2(aFile, bFile *File, config DifferencerConfig) (pairs []*BlockP
 		mase = FindMiddleAndSharedEnds(rootRangePair, config)
 		if mase != nil {
 			if mase.sharedEndsData.RangesAreEqual {
-				return
+				pair := &BlockPair{
+					AIndex:  0,
+					ALength: aFile.LineCount(),
+					BIndex:  0,
+					BLength: bFile.LineCount(),
+					IsMatch: true,
+				}
+				return append(pairs, pair)
 			} else if mase.sharedEndsData.RangesAreApproximatelyEqual {
 				glog.Info("PerformDiff2: files are identical after normalization")
-				// TODO Calculate indentation changes.
-				panic("TODO Calculate indentation changes. Make BlockPairs")
+				pair := &BlockPair{
+					AIndex:            0,
+					ALength:           aFile.LineCount(),
+					BIndex:            0,
+					BLength:           bFile.LineCount(),
+					IsNormalizedMatch: true,
+				}
+				return SplitIndentationChanges(aFile, bFile, append(pairs, pair))
 			}
 			middleRangePair = mase.middleRangePair
 		}
@@ -49,25 +62,7 @@ func PerformDiff2(aFile, bFile *File, config DifferencerConfig) (pairs []*BlockP
 
 	// Phase 2: LCS alignment.
 
-	maxRareOccurrences := uint8(MaxInt(1, MinInt(255, config.MaxRareLineOccurrencesInFile)))
-	normSim := MaxFloat32(0, MinFloat32(1, float32(config.LcsNormalizedSimilarity)))
-	halfDelta := (1 - normSim) / 2
-	sf := SimilarityFactors{
-		MaxRareOccurrences: maxRareOccurrences,
-		ExactRare:          1,
-		NormalizedRare:     normSim,
-		ExactNonRare:       1 - halfDelta,
-		NormalizedNonRare:  MaxFloat32(0, normSim-halfDelta),
-	}
-	if !config.AlignNormalizedLines {
-		sf.NormalizedRare = 0
-		sf.NormalizedNonRare = 0
-	}
-	if config.AlignRareLines {
-		sf.ExactNonRare = 0
-		sf.NormalizedNonRare = 0
-	}
-
+	sf := diff2SimilarityFactors(config)
 	lcsData := PerformLCS(middleRangePair, config, sf)
 
 	if glog.V(1) {
@@ -125,12 +120,28 @@ func PerformDiff2(aFile, bFile *File, config DifferencerConfig) (pairs []*BlockP
 
 	// TODO Split mixed matches.
 
+	if len(allMatches) == 0 {
+		// The files have no lines in common, so the whole of each is changed.
+		// (CombineBlockPairs requires at least one BlockPair.)
+		pair := &BlockPair{
+			AIndex:  0,
+			ALength: aFile.LineCount(),
+			BIndex:  0,
+			BLength: bFile.LineCount(),
+		}
+		return append(pairs, pair)
+	}
+
 	// Combine matches.
 	SortBlockPairsByBIndex(allMatches)
 	allMatches = CombineBlockPairs(allMatches)
 
 	allPairs := FillRemainingBGapsWithMismatches(filePair, allMatches)
 
+	// Phase 4c: Identify runs of lines whose indentation was changed.
+
+	allPairs = SplitIndentationChanges(aFile, bFile, allPairs)
+
 	return allPairs
 
 	// TODO Phase 5: copy detection (match a gap in B with similar size region anywhere in file A)
@@ -151,6 +162,29 @@ func PerformDiff2(aFile, bFile *File, config DifferencerConfig) (pairs []*BlockP
 
 }
 
+// Returns the weights used for aligning lines, per the config.
+func diff2SimilarityFactors(config DifferencerConfig) SimilarityFactors {
+	maxRareOccurrences := uint8(MaxInt(1, MinInt(255, config.MaxRareLineOccurrencesInFile)))
+	normSim := MaxFloat32(0, MinFloat32(1, float32(config.LcsNormalizedSimilarity)))
+	halfDelta := (1 - normSim) / 2
+	sf := SimilarityFactors{
+		MaxRareOccurrences: maxRareOccurrences,
+		ExactRare:          1,
+		NormalizedRare:     normSim,
+		ExactNonRare:       1 - halfDelta,
+		NormalizedNonRare:  MaxFloat32(0, normSim-halfDelta),
+	}
+	if !config.AlignNormalizedLines {
+		sf.NormalizedRare = 0
+		sf.NormalizedNonRare = 0
+	}
+	if config.AlignRareLines {
+		sf.ExactNonRare = 0
+		sf.NormalizedNonRare = 0
+	}
+	return sf
+}
+
 func ExtendMatchesForward(filePair FilePair, inputPairs BlockPairs) (outputPairs BlockPairs) {
 	matchedALines := AIndexBlockPairsToIntervalSet(
 		inputPairs, SelectAllBlockPairs)
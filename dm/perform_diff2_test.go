@@ -0,0 +1,20 @@
+package dm
+
+import (
+	"testing"
+)
+
+func TestPerformDiff2NoLinesInCommon(t *testing.T) {
+	cfg := DefaultDifferencerConfig()
+	aFile, _ := BuildFile("a", []byte("one\ntwo\n"))
+	bFile, _ := BuildFile("b", []byte("three\nfour\nfive\n"))
+	pairs := PerformDiff2(aFile, bFile, cfg)
+	if len(pairs) != 1 {
+		t.Fatalf("Expected 1 BlockPair, not %d", len(pairs))
+	}
+	pair := pairs[0]
+	if pair.IsMatch || pair.IsNormalizedMatch || pair.AIndex != 0 ||
+		pair.ALength != 2 || pair.BIndex != 0 || pair.BLength != 3 {
+		t.Errorf("Expected a mismatch of all lines of both files: %+v", *pair)
+	}
+}
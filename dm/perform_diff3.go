@@ -1,19 +1,118 @@
 package dm
 
-import ()
+import (
+	"bytes"
+
+	"github.com/golang/glog"
+)
 
 // Given 3 files where both yours and theirs are different from base, compute a
 // 3-way diff, analogous to diff3. The goal is to identify those blocks that
 // are unchanged, are different in only one file, or are changed in both yours
-// and theirs. No attempt is made to resolve the differences. Every BlockPair
-// in the inputs will appear in at least one of the Diff3Triples return,
-// possibly more than one (based on the alignment of changes/moves/conflicts).
+// and theirs. No attempt is made to resolve the differences.
+//
+// The returned Diff3Triples are in base order, and together cover every line
+// of base, yours and theirs exactly once. Each triple has both a B2YPair and
+// a B2TPair, describing the lines of yours and theirs (respectively) that
+// correspond to the base lines of the triple; when one of those files is
+// unchanged in the region, its BlockPair is an exact match.
+//
+// Moved blocks are treated as a deletion at their original location in base
+// and an insertion at their new location, as diff3 would.
 func PerformDiff3(
 	yours, base, theirs *File, b2yPairs, b2tPairs BlockPairs,
 	cfg DifferencerConfig) (triples Diff3Triples, conflictsExist bool) {
+	defer glog.Flush()
 	SortBlockPairsByAIndex(b2yPairs)
 	SortBlockPairsByAIndex(b2tPairs)
 
+	_, yChanges := BaseAnchoredChanges(base, yours, b2yPairs)
+	_, tChanges := BaseAnchoredChanges(base, theirs, b2tPairs)
+
+	glog.Infof("PerformDiff3: %d changed regions in yours, %d in theirs",
+		len(yChanges), len(tChanges))
+
+	// The difference between the index of a line in yours (or theirs) and the
+	// index of the same line in base, in the region after the last change
+	// consumed from yChanges (tChanges).
+	yDelta, tDelta := 0, 0
+	yi, ti := 0, 0
+	baseIndex := 0
+
+	emitUnchanged := func(baseBeyond int) {
+		if baseIndex >= baseBeyond {
+			return
+		}
+		length := baseBeyond - baseIndex
+		triples = append(triples, &Diff3Triple{
+			TripleType: UnchangedTriple,
+			BaseStart:  baseIndex,
+			BaseBeyond: baseBeyond,
+			B2YPair:    makeMatchPair(baseIndex, baseIndex+yDelta, length),
+			B2TPair:    makeMatchPair(baseIndex, baseIndex+tDelta, length),
+		})
+		baseIndex = baseBeyond
+	}
+
+	for yi < len(yChanges) || ti < len(tChanges) {
+		// Find the start of the next group of overlapping changes.
+		groupStart := base.LineCount()
+		if yi < len(yChanges) {
+			groupStart = MinInt(groupStart, yChanges[yi].AIndex)
+		}
+		if ti < len(tChanges) {
+			groupStart = MinInt(groupStart, tChanges[ti].AIndex)
+		}
+		emitUnchanged(groupStart)
+
+		// Grow the group for as long as there is a change in yours or theirs that
+		// overlaps or touches the group. Two changes in the same file are always
+		// separated by at least one matching line, so only changes in the other
+		// file can extend the group.
+		groupBeyond := groupStart
+		yFirst, tFirst := yi, ti
+		for {
+			if yi < len(yChanges) && yChanges[yi].AIndex <= groupBeyond {
+				groupBeyond = MaxInt(groupBeyond, yChanges[yi].ABeyond())
+				yi++
+			} else if ti < len(tChanges) && tChanges[ti].AIndex <= groupBeyond {
+				groupBeyond = MaxInt(groupBeyond, tChanges[ti].ABeyond())
+				ti++
+			} else {
+				break
+			}
+		}
+
+		yPair, yChanged := makeDiff3GroupPair(
+			groupStart, groupBeyond, yChanges[yFirst:yi], &yDelta)
+		tPair, tChanged := makeDiff3GroupPair(
+			groupStart, groupBeyond, tChanges[tFirst:ti], &tDelta)
+
+		triple := &Diff3Triple{
+			BaseStart:  groupStart,
+			BaseBeyond: groupBeyond,
+			B2YPair:    yPair,
+			B2TPair:    tPair,
+		}
+		if yChanged && tChanged {
+			if rangesHaveSameLines(yours, yPair.BIndex, yPair.BLength,
+				theirs, tPair.BIndex, tPair.BLength) {
+				triple.TripleType = BothSameTriple
+			} else {
+				triple.TripleType = ConflictTriple
+				conflictsExist = true
+			}
+		} else if yChanged {
+			triple.TripleType = YoursChangedTriple
+		} else {
+			triple.TripleType = TheirsChangedTriple
+		}
+		glog.V(1).Infof("PerformDiff3 emitting %v", triple)
+		triples = append(triples, triple)
+		baseIndex = groupBeyond
+	}
+	emitUnchanged(base.LineCount())
+
 	return
 }
 
@@ -27,6 +126,22 @@ const (
 	ConflictTriple
 )
 
+func (t Diff3TripleType) String() string {
+	switch t {
+	case UnchangedTriple:
+		return "Unchanged"
+	case YoursChangedTriple:
+		return "YoursChanged"
+	case TheirsChangedTriple:
+		return "TheirsChanged"
+	case BothSameTriple:
+		return "BothSame"
+	case ConflictTriple:
+		return "Conflict"
+	}
+	return "Diff3TripleType(?)"
+}
+
 type Diff3Triple struct {
 	TripleType Diff3TripleType
 
@@ -37,3 +152,160 @@ type Diff3Triple struct {
 	B2YPair, B2TPair *BlockPair
 }
 type Diff3Triples []*Diff3Triple
+
+// Returns the start and beyond indices of the lines of yours in the triple.
+func (p *Diff3Triple) YoursRange() (start, beyond int) {
+	return p.B2YPair.BIndex, p.B2YPair.BBeyond()
+}
+
+// Returns the start and beyond indices of the lines of theirs in the triple.
+func (p *Diff3Triple) TheirsRange() (start, beyond int) {
+	return p.B2TPair.BIndex, p.B2TPair.BBeyond()
+}
+
+func (s Diff3Triples) CountConflicts() (count int) {
+	for _, triple := range s {
+		if triple.TripleType == ConflictTriple {
+			count++
+		}
+	}
+	return
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Given the BlockPairs produced by PerformDiff2(aFile, bFile), select the
+// longest (by number of lines) sequence of exact matches that is in order in
+// both files (the anchors), and return the regions between those anchors as
+// mismatch BlockPairs (the changes). Both anchors and changes are sorted by
+// AIndex, and are in order in both files; together they cover both files.
+// This discards moves, which become a deletion and an insertion.
+func BaseAnchoredChanges(aFile, bFile *File, pairs BlockPairs) (
+	anchors, changes BlockPairs) {
+	anchors = longestOrderedChain(exactMatchRuns(aFile, bFile, pairs))
+	aLo, bLo := 0, 0
+	addChange := func(aHi, bHi int) {
+		if aLo < aHi || bLo < bHi {
+			changes = append(changes, &BlockPair{
+				AIndex:  aLo,
+				ALength: aHi - aLo,
+				BIndex:  bLo,
+				BLength: bHi - bLo,
+			})
+		}
+	}
+	for _, anchor := range anchors {
+		addChange(anchor.AIndex, anchor.BIndex)
+		aLo, bLo = anchor.ABeyond(), anchor.BBeyond()
+	}
+	addChange(aFile.LineCount(), bFile.LineCount())
+	return
+}
+
+// Splits the matches in pairs into runs of lines that are exactly equal (i.e.
+// omitting lines that only match after normalization), sorted by AIndex.
+func exactMatchRuns(aFile, bFile *File, pairs BlockPairs) (runs BlockPairs) {
+	for _, pair := range pairs {
+		if !(pair.IsMatch || pair.IsNormalizedMatch) || pair.ALength != pair.BLength {
+			continue
+		}
+		var run *BlockPair
+		for n := 0; n < pair.ALength; n++ {
+			aIndex, bIndex := pair.AIndex+n, pair.BIndex+n
+			if !bytes.Equal(aFile.GetLineBytes(aIndex), bFile.GetLineBytes(bIndex)) {
+				run = nil
+				continue
+			}
+			if run == nil {
+				run = makeMatchPair(aIndex, bIndex, 0)
+				run.IsMove = pair.IsMove
+				run.MoveId = pair.MoveId
+				runs = append(runs, run)
+			}
+			run.ALength++
+			run.BLength++
+		}
+	}
+	SortBlockPairsByAIndex(runs)
+	return
+}
+
+// Returns the subset of the runs (which must be sorted by AIndex) that are in
+// order in both A and B, and that have the greatest number of lines.
+func longestOrderedChain(runs BlockPairs) (chain BlockPairs) {
+	if len(runs) == 0 {
+		return
+	}
+	// Dynamic programming: bestLength[n] is the number of lines in the best
+	// chain ending with runs[n], and prev[n] is the index of the previous run in
+	// that chain (or -1).
+	bestLength := make([]int, len(runs))
+	prev := make([]int, len(runs))
+	bestEnd := 0
+	for n, run := range runs {
+		bestLength[n] = run.ALength
+		prev[n] = -1
+		for m := 0; m < n; m++ {
+			if BlockPairsLess(runs[m], run) && bestLength[m]+run.ALength > bestLength[n] {
+				bestLength[n] = bestLength[m] + run.ALength
+				prev[n] = m
+			}
+		}
+		if bestLength[n] > bestLength[bestEnd] {
+			bestEnd = n
+		}
+	}
+	for n := bestEnd; n >= 0; n = prev[n] {
+		chain = append(chain, runs[n])
+	}
+	// Reverse the chain.
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return
+}
+
+func makeMatchPair(aIndex, bIndex, length int) *BlockPair {
+	return &BlockPair{
+		AIndex:  aIndex,
+		ALength: length,
+		BIndex:  bIndex,
+		BLength: length,
+		IsMatch: true,
+	}
+}
+
+// Produces the BlockPair describing the lines of one of the changed files
+// that correspond to the base lines [groupStart, groupBeyond), given the
+// changes (possibly none) that file has within that range. *delta is the
+// difference between line indices in the changed file and in base before
+// the group, and is updated to be the difference after the group.
+func makeDiff3GroupPair(groupStart, groupBeyond int, changes BlockPairs,
+	delta *int) (pair *BlockPair, changed bool) {
+	bStart := groupStart + *delta
+	if len(changes) == 0 {
+		return makeMatchPair(groupStart, bStart, groupBeyond-groupStart), false
+	}
+	last := changes[len(changes)-1]
+	*delta = last.BBeyond() - last.ABeyond()
+	pair = &BlockPair{
+		AIndex:  groupStart,
+		ALength: groupBeyond - groupStart,
+		BIndex:  bStart,
+		BLength: groupBeyond + *delta - bStart,
+	}
+	return pair, true
+}
+
+func rangesHaveSameLines(
+	aFile *File, aIndex, aLength int, bFile *File, bIndex, bLength int) bool {
+	if aLength != bLength {
+		return false
+	}
+	for n := 0; n < aLength; n++ {
+		if !bytes.Equal(aFile.GetLineBytes(aIndex+n), bFile.GetLineBytes(bIndex+n)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package dm
+
+import (
+	"testing"
+)
+
+// Every line of each file must appear in exactly one triple, in order.
+func checkTriplesCoverFiles(t *testing.T, yours, base, theirs *File, triples Diff3Triples) {
+	yNext, bNext, tNext := 0, 0, 0
+	for n, triple := range triples {
+		yStart, yBeyond := triple.YoursRange()
+		tStart, tBeyond := triple.TheirsRange()
+		if triple.BaseStart != bNext || yStart != yNext || tStart != tNext {
+			t.Errorf("Triple #%d (%v) doesn't start where the previous ended", n, triple)
+		}
+		yNext, bNext, tNext = yBeyond, triple.BaseBeyond, tBeyond
+	}
+	if yNext != yours.LineCount() || bNext != base.LineCount() || tNext != theirs.LineCount() {
+		t.Errorf("Triples don't cover the files: %d, %d, %d", yNext, bNext, tNext)
+	}
+}
+
+func TestPerformDiff3OneSideChanged(t *testing.T) {
+	yours, base, theirs, triples, conflictsExist := performTestDiff3(t, "lao", "lao", "tzu")
+	if conflictsExist {
+		t.Errorf("Expected no conflicts")
+	}
+	checkTriplesCoverFiles(t, yours, base, theirs, triples)
+	for n, triple := range triples {
+		if triple.TripleType != UnchangedTriple && triple.TripleType != TheirsChangedTriple {
+			t.Errorf("Triple #%d has unexpected type: %v", n, triple.TripleType)
+		}
+	}
+}
+
+func TestPerformDiff3Conflict(t *testing.T) {
+	yours, base, theirs, triples, conflictsExist := performTestDiff3(
+		t, "conflict1_yours", "conflict1_base", "conflict1_theirs")
+	if !conflictsExist {
+		t.Errorf("Expected conflicts")
+	}
+	checkTriplesCoverFiles(t, yours, base, theirs, triples)
+	if triples.CountConflicts() != 1 {
+		t.Errorf("Expected 1 conflict, not %d", triples.CountConflicts())
+	}
+	for _, triple := range triples {
+		if triple.TripleType == ConflictTriple && (triple.BaseStart != 7 || triple.BaseBeyond != 8) {
+			t.Errorf("Conflict is in the wrong place: %v", *triple)
+		}
+	}
+}
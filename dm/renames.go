@@ -0,0 +1,133 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+// Detects identifiers that were renamed by a changed file (see README problem
+// #5), so that the rename can be applied to the uses of the identifier that
+// the other changed file introduced. An identifier is considered renamed if,
+// in every changed line that contained it, it was replaced by the same new
+// identifier (and by nothing else), and it doesn't appear anywhere in the
+// changed file.
+
+// An identifier which was consistently replaced by another.
+type Rename struct {
+	Old, New string
+
+	// The number of changed lines in which Old was replaced by New.
+	NumLines int
+}
+
+func (p *Rename) String() string {
+	return fmt.Sprintf("%s -> %s", p.Old, p.New)
+}
+
+func isIdentifierToken(token []byte) bool {
+	r, _ := utf8.DecodeRune(token)
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// Detects the identifiers renamed in changedFile, given BlockPairs describing
+// the lines of baseFile that were changed (e.g. as produced by PerformDiff2,
+// or the B2YPairs of Diff3Triples).
+func DetectRenames(baseFile, changedFile *File, pairs BlockPairs) (renames []*Rename) {
+	candidates := make(map[string]*Rename)
+	rejected := make(map[string]bool)
+	intraLineDiffs := PerformIntraLineDiff(baseFile, changedFile, pairs)
+	for _, d := range intraLineDiffs.byALine {
+		// The replacements made in this line, which must be consistent with
+		// each other, and with those in other lines.
+		lineRenames := make(map[string]string)
+		for _, pair := range d.Pairs {
+			if pair.IsMatch {
+				continue
+			}
+			for _, token := range d.ATokens[pair.AIndex:pair.ABeyond()] {
+				if !isIdentifierToken(token) {
+					continue
+				}
+				old := string(token)
+				if pair.ALength != 1 || pair.BLength != 1 ||
+					!isIdentifierToken(d.BTokens[pair.BIndex]) {
+					// Not a simple replacement of one identifier with another.
+					rejected[old] = true
+					continue
+				}
+				newName := string(d.BTokens[pair.BIndex])
+				if prev, ok := lineRenames[old]; ok && prev != newName {
+					rejected[old] = true
+				}
+				lineRenames[old] = newName
+			}
+		}
+		// Occurrences of an identifier that were left unchanged in a changed line
+		// mean that it wasn't renamed.
+		for _, pair := range d.Pairs {
+			if pair.IsMatch {
+				for _, token := range d.ATokens[pair.AIndex:pair.ABeyond()] {
+					if _, ok := lineRenames[string(token)]; ok {
+						rejected[string(token)] = true
+					}
+				}
+			}
+		}
+		for old, newName := range lineRenames {
+			if c, ok := candidates[old]; !ok {
+				candidates[old] = &Rename{Old: old, New: newName, NumLines: 1}
+			} else if c.New != newName {
+				rejected[old] = true
+			} else {
+				c.NumLines++
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// The old name must be entirely gone from the changed file.
+	for n := 0; n < changedFile.LineCount(); n++ {
+		for _, token := range TokenizeLine(changedFile.GetLineBytes(n)) {
+			if _, ok := candidates[string(token)]; ok {
+				rejected[string(token)] = true
+			}
+		}
+	}
+	for old, c := range candidates {
+		if !rejected[old] {
+			renames = append(renames, c)
+		}
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].Old < renames[j].Old })
+	glog.Infof("DetectRenames found %d renames: %v", len(renames), renames)
+	return
+}
+
+// Returns the line with the renames applied to its identifiers, and the
+// renames that were applied (if none, the line is returned unmodified).
+func ApplyRenames(line []byte, renames []*Rename) (result []byte, applied []*Rename) {
+	byOld := make(map[string]*Rename)
+	for _, r := range renames {
+		byOld[r.Old] = r
+	}
+	tokens := TokenizeLine(line)
+	var buf bytes.Buffer
+	for _, token := range tokens {
+		if r, ok := byOld[string(token)]; ok {
+			buf.WriteString(r.New)
+			applied = append(applied, r)
+		} else {
+			buf.Write(token)
+		}
+	}
+	if len(applied) == 0 {
+		return line, nil
+	}
+	return buf.Bytes(), applied
+}
@@ -5,6 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
@@ -27,15 +32,12 @@ import (
 // The C character (code) in the middle will represent the kind of change:
 //   = means lines are the same
 //   ~ means lines are the same after normalization
+//   I means lines differ only by the same change to their indentation
 //   ! means lines are different
 //   < means lines inserted in A
 //   > means lines inserted in B
 //   M means a move is detected
 
-// TODO Maybe handle non-ASCII files, i.e. multi-byte characters, which display
-// as a single character, but are multiple bytes of input, which throws off
-// width calculations/alignment.
-
 // Inputs to display process, unrelated to the actual files.
 type SideBySideConfig struct {
 	// How many columns (mono-spaced characters) does the output 'device' have?
@@ -51,6 +53,16 @@ type SideBySideConfig struct {
 	ContextLines int
 
 	ZeroBasedLineNumbers bool
+
+	// Color the columns and code character by the kind of block, using ANSI
+	// escape sequences (see ShouldUseColor).
+	Color bool
+
+	// Divide the columns between A and B according to the width of the
+	// longest line displayed from each file, rather than equally, so that a
+	// file with long lines doesn't wrap needlessly when the other file's
+	// lines are short.
+	AdaptiveColumnWidths bool
 }
 
 var DefaultSideBySideConfig = SideBySideConfig{
@@ -62,11 +74,48 @@ var DefaultSideBySideConfig = SideBySideConfig{
 	ZeroBasedLineNumbers: false,
 }
 
+// Supports -output-columns, which is either a number of columns, or "auto"
+// for the width of the terminal (see TerminalColumns).
+type outputColumnsFlag struct {
+	columns *int
+}
+
+func (p outputColumnsFlag) String() string {
+	if p.columns == nil {
+		return ""
+	}
+	return fmt.Sprint(*p.columns)
+}
+
+func (p outputColumnsFlag) Set(value string) error {
+	if value == "auto" {
+		*p.columns = TerminalColumns(os.Stdout, *p.columns)
+		return nil
+	}
+	columns, err := strconv.Atoi(value)
+	if err != nil || columns <= 0 {
+		return fmt.Errorf("expected a positive number of columns, or \"auto\"")
+	}
+	*p.columns = columns
+	return nil
+}
+
 func init() {
-	flag.IntVar(
-		&DefaultSideBySideConfig.DisplayColumns, "output-columns",
-		DefaultSideBySideConfig.DisplayColumns,
-		"Number of columns in side-by-side display")
+	flag.Var(
+		outputColumnsFlag{&DefaultSideBySideConfig.DisplayColumns}, "output-columns",
+		"Number of columns in side-by-side display, or \"auto\" for the width "+
+			"of the terminal")
+
+	flag.BoolVar(
+		&DefaultSideBySideConfig.AdaptiveColumnWidths, "adaptive-columns",
+		DefaultSideBySideConfig.AdaptiveColumnWidths,
+		"In side-by-side display, divide the columns between the files "+
+			"according to the lengths of their lines")
+
+	flag.BoolVar(
+		&DefaultSideBySideConfig.DisplayLineNumbers, "line-numbers",
+		DefaultSideBySideConfig.DisplayLineNumbers,
+		"In side-by-side display, show line numbers")
 
 	flag.IntVar(
 		&DefaultSideBySideConfig.ContextLines, "context",
@@ -79,9 +128,6 @@ func init() {
 		"Start at line number zero (default is starting at line number one).")
 }
 
-// TODO Measure width of longest line in each file so that we can decide to
-// give more space to one file than the other IFF they require different widths.
-
 type sideBySideState struct {
 	cfg SideBySideConfig
 
@@ -89,6 +135,9 @@ type sideBySideState struct {
 	aFile, bFile *File
 	// // The exact and approximate matches, moves and copies, and differences.
 	pairs []*BlockPair
+	// If not nil, and cfg.Color is true, the changed tokens of changed lines
+	// are highlighted.
+	intraLineDiffs *IntraLineDiffs
 
 	aDigitColumns, aOutputColumns int
 	bDigitColumns, bOutputColumns int
@@ -130,13 +179,18 @@ func (state *sideBySideState) initialize() {
 
 	state.aOutputColumns = MaxInt(availableOutputColumns/2, 10)
 	state.bOutputColumns = state.aOutputColumns
+	if state.cfg.AdaptiveColumnWidths {
+		aWidth, bWidth := state.measureDisplayedLines()
+		state.aOutputColumns, state.bOutputColumns = allocateColumns(
+			availableOutputColumns, aWidth, bWidth)
+	}
 
 	var totalColumns int
 	if state.cfg.DisplayLineNumbers {
 		state.aDigitOffset = 0
 		state.aOutputOffset = 1 + state.aDigitColumns + state.aDigitOffset
 		state.codeOffset = 1 + state.aOutputOffset + state.aOutputColumns
-		state.bOutputOffset = 2 + state.aOutputOffset
+		state.bOutputOffset = 2 + state.codeOffset
 		state.bDigitOffset = 1 + state.bOutputOffset + state.bOutputColumns
 		totalColumns = state.bDigitOffset + state.bDigitColumns
 
@@ -144,7 +198,7 @@ func (state *sideBySideState) initialize() {
 	} else {
 		state.aOutputOffset = 0
 		state.codeOffset = 1 + state.aOutputOffset + state.aOutputColumns
-		state.bOutputOffset = 2 + state.aOutputOffset
+		state.bOutputOffset = 2 + state.codeOffset
 		totalColumns = state.bOutputOffset + state.bOutputColumns
 
 		state.lineFormat = "%s %s %s\n"
@@ -158,47 +212,128 @@ func (state *sideBySideState) initialize() {
 	state.lineBuffer = bytes.NewBuffer(state.lineBuf)
 }
 
+// Returns the width of the longest line of each file that will be displayed
+// (i.e. omitting the unchanged lines that aren't within ContextLines of a
+// change).
+func (state *sideBySideState) measureDisplayedLines() (aWidth, bWidth int) {
+	lineWidth := func(f *File, index int) int {
+		bufs := state.cfg.lineToOutputBufs(f.GetLineBytes(index), math.MaxInt32)
+		if len(bufs) == 0 {
+			return 0
+		}
+		return StringWidth(bufs[0])
+	}
+	for _, pair := range state.pairs {
+		state.visitBlockPairRows(pair, func(aIndex, bIndex int) {
+			if aIndex >= 0 {
+				aWidth = MaxInt(aWidth, lineWidth(state.aFile, aIndex))
+			}
+			if bIndex >= 0 {
+				bWidth = MaxInt(bWidth, lineWidth(state.bFile, bIndex))
+			}
+		}, func() {})
+	}
+	return
+}
+
+// Divides the available columns between A and B, whose longest lines are
+// aWidth and bWidth columns wide. If both fit, the spare columns are divided
+// equally; if only the narrower fits in half of the columns, the wider gets
+// the remainder; otherwise they are divided equally. Each gets at least 10
+// columns.
+func allocateColumns(available, aWidth, bWidth int) (aColumns, bColumns int) {
+	aWidth, bWidth = MaxInt(aWidth, 10), MaxInt(bWidth, 10)
+	half := available / 2
+	switch {
+	case aWidth+bWidth <= available:
+		spare := available - aWidth - bWidth
+		aColumns = aWidth + spare/2
+		bColumns = available - aColumns
+	case aWidth <= half:
+		aColumns, bColumns = aWidth, available-aWidth
+	case bWidth <= half:
+		aColumns, bColumns = available-bWidth, bWidth
+	default:
+		aColumns, bColumns = half, half
+	}
+	return MaxInt(aColumns, 10), MaxInt(bColumns, 10)
+}
+
 func (p *SideBySideConfig) lineToOutputBufs(line []byte, numColumns int) (bufs [][]byte) {
+	bufs, _ = p.lineToOutputBufsWithMasks(line, numColumns, nil)
+	return
+}
+
+// Like lineToOutputBufs, but also returns, for each output buf, a mask
+// indicating which of its bytes come from the changedRanges of line.
+// Each buf occupies at most numColumns columns of the display, where wide
+// characters (e.g. CJK ideographs) occupy two columns, and combining marks
+// none (see RuneWidth); a character is never split between bufs.
+func (p *SideBySideConfig) lineToOutputBufsWithMasks(
+	line []byte, numColumns int, changedRanges []IndexPair) (bufs [][]byte, masks [][]bool) {
+	changed := changedBytesMask(len(line), changedRanges)
+	spacesPerTab := p.SpacesPerTab
+	if spacesPerTab <= 0 {
+		spacesPerTab = 8
+	}
 	var curBuf []byte
-	bytesOutput := 0
+	var curMask []bool
+	curColumns := 0  // Number of columns occupied by curBuf.
+	lineColumns := 0 // Number of columns output for the line, for tab stops.
 	stop := false
-	doOutput := func(b byte) {
-		if len(curBuf) >= numColumns {
+	doOutput := func(char []byte, width int, isChanged bool) {
+		if width > 0 && curColumns > 0 && curColumns+width > numColumns {
+			// A wide character may not fit in the last column, so pad instead.
+			for ; curColumns < numColumns; curColumns++ {
+				curBuf = append(curBuf, ' ')
+				curMask = append(curMask, false)
+			}
 			bufs = append(bufs, curBuf)
+			masks = append(masks, curMask)
 			stop = !p.WrapLongLines
 			curBuf = make([]byte, 0, numColumns)
+			curMask = make([]bool, 0, numColumns)
+			curColumns = 0
+		}
+		for range char {
+			curMask = append(curMask, isChanged)
 		}
-		curBuf = append(curBuf, b)
-		bytesOutput++
-	}
-	for _, b := range line {
-		// Only printable ASCII for now, plus tabs.
-		if 32 <= b && b <= 126 {
-			doOutput(b)
-		} else if b == '\t' {
-			bo := bytesOutput + 1
-			nextTabStop := bo + (p.SpacesPerTab - bo%p.SpacesPerTab)
-			for bytesOutput < nextTabStop {
-				doOutput(' ')
+		curBuf = append(curBuf, char...)
+		curColumns += width
+		lineColumns += width
+	}
+	for offset := 0; offset < len(line) && !stop; {
+		r, size := utf8.DecodeRune(line[offset:])
+		isChanged := changed != nil && changed[offset]
+		if r == '\t' {
+			nextTabStop := (lineColumns/spacesPerTab + 1) * spacesPerTab
+			for lineColumns < nextTabStop && !stop {
+				doOutput([]byte{' '}, 1, isChanged)
 			}
-		} else if b == '\n' || b == '\r' {
+		} else if r == '\n' || r == '\r' {
 			// Suppress
+		} else if unicode.IsControl(r) || (r == utf8.RuneError && size == 1) {
+			// Based on code page 437 on windows, this is a gray block.
+			doOutput([]byte("\u2591"), 1, isChanged)
 		} else {
-			doOutput(176) // Based on code page 437 on windows, this is a gray block.
-		}
-		if stop {
-			return bufs[0:1]
+			doOutput(line[offset:offset+size], RuneWidth(r), isChanged)
 		}
+		offset += size
+	}
+	if stop {
+		return bufs[0:1], masks[0:1]
 	}
 	if len(curBuf) > 0 {
 		bufs = append(bufs, curBuf)
+		masks = append(masks, curMask)
 	}
-	return bufs
+	return bufs, masks
 }
 
 // The C character (code) in the middle will represent the kind of change:
 //   = means lines are the same
 //   ~ means lines are the same after normalization
+//   I means lines differ only by the same change to their indentation
 //   ! means lines are different
 //   < means lines inserted in A
 //   > means lines inserted in B
@@ -216,6 +351,8 @@ func (state *sideBySideState) getCodeForBlockPair(pair *BlockPair) byte {
 	if pair.IsNormalizedMatch {
 		if pair.IsMove {
 			return 'm'
+		} else if pair.IndentationChange != nil {
+			return 'I'
 		} else {
 			return '~'
 		}
@@ -239,7 +376,7 @@ func selectOutputBuf(bufs [][]byte, n, cols int) (buf []byte) {
 		buf = make([]byte, 0, cols)
 	}
 	// Pad short bufs
-	for len(buf) < cols {
+	for width := StringWidth(buf); width < cols; width++ {
 		buf = append(buf, ' ')
 	}
 	return
@@ -247,13 +384,42 @@ func selectOutputBuf(bufs [][]byte, n, cols int) (buf []byte) {
 
 func (state *sideBySideState) outputABLines(aIndex, bIndex int, code string) {
 	var aBufs, bBufs [][]byte
+	var aMasks, bMasks [][]bool
+	var aChanged, bChanged []IndexPair
+	if state.cfg.Color && code != "=" {
+		if d := state.intraLineDiffs.ForALine(aIndex); aIndex >= 0 && d != nil {
+			aChanged, _ = d.ChangedByteRanges()
+		}
+		if d := state.intraLineDiffs.ForBLine(bIndex); bIndex >= 0 && d != nil {
+			_, bChanged = d.ChangedByteRanges()
+		}
+	}
 	if aIndex >= 0 {
 		aBytes := state.aFile.GetLineBytes(aIndex)
-		aBufs = state.cfg.lineToOutputBufs(aBytes, state.aOutputColumns)
+		aBufs, aMasks = state.cfg.lineToOutputBufsWithMasks(aBytes, state.aOutputColumns, aChanged)
 	}
 	if bIndex >= 0 {
 		bBytes := state.bFile.GetLineBytes(bIndex)
-		bBufs = state.cfg.lineToOutputBufs(bBytes, state.bOutputColumns)
+		bBufs, bMasks = state.cfg.lineToOutputBufsWithMasks(bBytes, state.bOutputColumns, bChanged)
+	}
+	// Returns the text of the column, colored if requested.
+	columnText := func(buf []byte, masks [][]bool, changed []IndexPair, n int, isA bool) string {
+		if !state.cfg.Color {
+			return string(buf)
+		}
+		color := colorForCode(code[0], isA)
+		if changed != nil && n < len(masks) {
+			return colorizeWithHighlights(buf, masks[n], color)
+		}
+		return colorize(string(buf), color)
+	}
+	codeText := code
+	if state.cfg.Color {
+		if code == "!" {
+			codeText = colorize(code, ansiBold+ansiYellow)
+		} else if color := colorForCode(code[0], false); color != "" {
+			codeText = colorize(code, ansiBold+color)
+		}
 	}
 
 	limit := MaxInt(1, MaxInt(len(aBufs), len(bBufs))) // If both are blank, want at least 1.
@@ -262,8 +428,8 @@ func (state *sideBySideState) outputABLines(aIndex, bIndex int, code string) {
 		aIndex, bIndex, code, len(aBufs), len(bBufs), limit)
 
 	for n := 0; n < limit; n++ {
-		aBuf := selectOutputBuf(aBufs, n, state.aOutputColumns)
-		bBuf := selectOutputBuf(bBufs, n, state.bOutputColumns)
+		aText := columnText(selectOutputBuf(aBufs, n, state.aOutputColumns), aMasks, aChanged, n, true)
+		bText := columnText(selectOutputBuf(bBufs, n, state.bOutputColumns), bMasks, bChanged, n, false)
 		if state.cfg.DisplayLineNumbers {
 			var aLineNo, bLineNo string
 			if n == 0 {
@@ -281,32 +447,30 @@ func (state *sideBySideState) outputABLines(aIndex, bIndex int, code string) {
 					bLineNo = "\""
 				}
 			}
-			fmt.Fprintf(state.w, state.lineFormat, aLineNo, aBuf, code, bBuf, bLineNo)
+			fmt.Fprintf(state.w, state.lineFormat, aLineNo, aText, codeText, bText, bLineNo)
 		} else {
-			fmt.Fprintf(state.w, state.lineFormat, aBuf, code, bBuf)
+			fmt.Fprintf(state.w, state.lineFormat, aText, codeText, bText)
 		}
 	}
 }
 
-func (state *sideBySideState) outputBlockPair(pair *BlockPair) {
-	glog.V(2).Infof("outputBlockPair: %v", *pair)
-
-	code := string([]byte{state.getCodeForBlockPair(pair)})
+// Calls visitRow with the index of the line of A and of B (or -1 if there is
+// no such line) for each row to be displayed for the pair, and visitElision
+// where unchanged lines aren't displayed (i.e. those not within ContextLines
+// of a change).
+func (state *sideBySideState) visitBlockPairRows(pair *BlockPair,
+	visitRow func(aIndex, bIndex int), visitElision func()) {
 	contextLines := state.cfg.ContextLines
 	if contextLines > 0 && pair.IsMatch && pair.ALength > 2*contextLines {
-		// Print first ContextLines of the pair, then a ... line, then print the
-		// last ContextLines of the pair.
+		// Visit first ContextLines of the pair, then the elision, then the last
+		// ContextLines of the pair.
 		for i := 0; i < contextLines; i++ {
-			aIndex := pair.AIndex + i
-			bIndex := pair.BIndex + i
-			state.outputABLines(aIndex, bIndex, code)
+			visitRow(pair.AIndex+i, pair.BIndex+i)
 		}
-		fmt.Fprintln(state.w, "...")
+		visitElision()
 		limit := pair.ALength
 		for i := limit - contextLines; i < limit; i++ {
-			aIndex := pair.AIndex + i
-			bIndex := pair.BIndex + i
-			state.outputABLines(aIndex, bIndex, code)
+			visitRow(pair.AIndex+i, pair.BIndex+i)
 		}
 		return
 	}
@@ -324,10 +488,21 @@ func (state *sideBySideState) outputBlockPair(pair *BlockPair) {
 		} else {
 			bIndex = -1
 		}
-		state.outputABLines(aIndex, bIndex, code)
+		visitRow(aIndex, bIndex)
 	}
 }
 
+func (state *sideBySideState) outputBlockPair(pair *BlockPair) {
+	glog.V(2).Infof("outputBlockPair: %v", *pair)
+
+	code := string([]byte{state.getCodeForBlockPair(pair)})
+	state.visitBlockPairRows(pair, func(aIndex, bIndex int) {
+		state.outputABLines(aIndex, bIndex, code)
+	}, func() {
+		fmt.Fprintln(state.w, "...")
+	})
+}
+
 func (state *sideBySideState) outputBlockPairs() {
 	for _, pair := range state.pairs {
 		state.outputBlockPair(pair)
@@ -336,6 +511,14 @@ func (state *sideBySideState) outputBlockPairs() {
 
 func FormatSideBySide(aFile, bFile *File, pairs []*BlockPair, aIsPrimary bool,
 	w io.Writer, config SideBySideConfig) {
+	FormatSideBySideWithIntraLineDiffs(aFile, bFile, pairs, aIsPrimary, nil, w, config)
+}
+
+// Like FormatSideBySide, but if config.Color is true and intraLineDiffs is
+// not nil, the changed tokens of changed lines are highlighted.
+func FormatSideBySideWithIntraLineDiffs(aFile, bFile *File, pairs []*BlockPair,
+	aIsPrimary bool, intraLineDiffs *IntraLineDiffs, w io.Writer,
+	config SideBySideConfig) {
 	pairs = append([]*BlockPair(nil), pairs...)
 	if aIsPrimary {
 		SortBlockPairsByAIndex(pairs)
@@ -349,6 +532,8 @@ func FormatSideBySide(aFile, bFile *File, pairs []*BlockPair, aIsPrimary bool,
 		bFile: bFile,
 		pairs: pairs,
 		w:     w,
+
+		intraLineDiffs: intraLineDiffs,
 	}
 
 	state.initialize()
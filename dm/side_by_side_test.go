@@ -0,0 +1,98 @@
+package dm
+
+import (
+	"testing"
+)
+
+func TestLineToOutputBufsWithWideCharacters(t *testing.T) {
+	cfg := DefaultSideBySideConfig
+	cfg.SpacesPerTab = 4
+	tests := []struct {
+		line     string
+		columns  int
+		expected []string
+	}{
+		{"abc\tdef\n", 20, []string{"abc def"}},
+		{"\tx\ty", 20, []string{"    x   y"}},
+		// A wide character that doesn't fit at the end of a buf is moved to the
+		// next buf, and the first padded.
+		{"日本語です", 5, []string{"日本 ", "語で ", "す"}},
+		// Combining marks occupy no columns, and stay with their base character.
+		{"cafés", 4, []string{"café", "s"}},
+		{"a\x01b", 10, []string{"a░b"}},
+	}
+	for _, test := range tests {
+		bufs := cfg.lineToOutputBufs([]byte(test.line), test.columns)
+		var actual []string
+		for _, buf := range bufs {
+			actual = append(actual, string(buf))
+			if w := StringWidth(buf); w > test.columns {
+				t.Errorf("Buf %q of line %q is %d columns wide", buf, test.line, w)
+			}
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("lineToOutputBufs(%q, %d) = %q, expected %q",
+				test.line, test.columns, actual, test.expected)
+			continue
+		}
+		for n := range actual {
+			if actual[n] != test.expected[n] {
+				t.Errorf("lineToOutputBufs(%q, %d) = %q, expected %q",
+					test.line, test.columns, actual, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestStringWidth(t *testing.T) {
+	for text, expected := range map[string]int{
+		"abc":         3,
+		"日本語":         6,
+		"é":          1,
+		"한국어":         6,
+		"ＡＢ":          4,
+		"\U0001F600!": 3,
+	} {
+		if w := StringWidth([]byte(text)); w != expected {
+			t.Errorf("StringWidth(%q) = %d, expected %d", text, w, expected)
+		}
+	}
+}
+
+func TestAllocateColumns(t *testing.T) {
+	tests := []struct {
+		available, aWidth, bWidth int
+		aColumns, bColumns        int
+	}{
+		{80, 10, 20, 35, 45},   // Both fit; the spare columns are divided equally.
+		{80, 5, 100, 10, 70},   // Only A fits; B gets the remainder.
+		{80, 100, 30, 50, 30},  // Only B fits.
+		{80, 100, 100, 40, 40}, // Neither fits.
+	}
+	for _, test := range tests {
+		a, b := allocateColumns(test.available, test.aWidth, test.bWidth)
+		if a != test.aColumns || b != test.bColumns {
+			t.Errorf("allocateColumns(%d, %d, %d) = %d, %d; expected %d, %d",
+				test.available, test.aWidth, test.bWidth, a, b, test.aColumns, test.bColumns)
+		}
+	}
+}
+
+func TestAdaptiveColumnWidthsAvoidWrapping(t *testing.T) {
+	aFile, _ := BuildFile("a", []byte("short\nx\n"))
+	bFile, _ := BuildFile("b", []byte("a much longer line that would be wrapped at half the width\nx\n"))
+	pairs := BlockPairs{
+		{AIndex: 0, ALength: 1, BIndex: 0, BLength: 1},
+		{AIndex: 1, ALength: 1, BIndex: 1, BLength: 1, IsMatch: true},
+	}
+	cfg := DefaultSideBySideConfig
+	cfg.DisplayColumns = 80
+	cfg.DisplayLineNumbers = false
+	cfg.AdaptiveColumnWidths = true
+	expected := "short          ! a much longer line that would be wrapped at half the width     \n" +
+		"x              = x                                                              \n"
+	if s := FormatSideBySideToString(aFile, bFile, pairs, false, cfg); s != expected {
+		t.Errorf("Unexpected side-by-side output:\n%q\nExpected:\n%q", s, expected)
+	}
+}
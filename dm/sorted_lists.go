@@ -0,0 +1,197 @@
+package dm
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// Detects conflicts within lexically sorted lists (e.g. C++ include lists or
+// build dependencies), and resolves them by treating the lists as ordered
+// sets: the lines deleted by yours or by theirs are removed, the lines
+// inserted by yours or by theirs are added, and the result is kept sorted.
+//
+// To avoid treating an arbitrary pair of conflicting lines as a list, the
+// lines of the conflict must all have the same indentation, and in each file
+// must be sorted along with at least one of the unchanged lines adjacent to
+// the conflict (i.e. the conflict is part of a longer list in all 3 files).
+
+// Computes the key by which the lines of a list are sorted.
+type SortKeyFunc func(line []byte) []byte
+
+// Returns a SortKeyFunc which removes the leading and trailing whitespace of
+// a line, and then any of the characters in cutset from both ends (e.g. `",`
+// for a list of quoted strings with trailing commas).
+func MakeTrimmingSortKeyFunc(cutset string) SortKeyFunc {
+	return func(line []byte) []byte {
+		return bytes.Trim(bytes.TrimSpace(line), cutset)
+	}
+}
+
+type sortedListLine struct {
+	key, line []byte
+}
+
+// Attempts to resolve the conflict as edits to a sorted list. If successful,
+// returns the lines of the resolved list, in order.
+func ResolveSortedListConflict(yours, base, theirs *File, triple *Diff3Triple,
+	keyFn SortKeyFunc) (resolved [][]byte, ok bool) {
+	yStart, yBeyond := triple.YoursRange()
+	tStart, tBeyond := triple.TheirsRange()
+	bStart, bBeyond := triple.BaseStart, triple.BaseBeyond
+
+	// The unchanged lines adjacent to the conflict are the same in all 3 files,
+	// so we use those in base.
+	var before, after []byte
+	if bStart > 0 {
+		before = base.GetLineBytes(bStart - 1)
+	}
+	if bBeyond < base.LineCount() {
+		after = base.GetLineBytes(bBeyond)
+	}
+
+	bLines, ok := getSortedListLines(base, bStart, bBeyond, keyFn)
+	if !ok {
+		return nil, false
+	}
+	yLines, ok := getSortedListLines(yours, yStart, yBeyond, keyFn)
+	if !ok {
+		return nil, false
+	}
+	tLines, ok := getSortedListLines(theirs, tStart, tBeyond, keyFn)
+	if !ok {
+		return nil, false
+	}
+	indent := findListIndent(bLines, yLines, tLines)
+	if indent == nil {
+		return nil, false
+	}
+
+	// At least one of the neighbors must be part of the list in all 3 files.
+	inList := func(neighbor []byte, isBefore bool) bool {
+		if neighbor == nil || !bytes.Equal(leadingWhitespace(neighbor), indent) {
+			return false
+		}
+		key := keyFn(neighbor)
+		if len(key) == 0 {
+			return false
+		}
+		for _, lines := range [][]sortedListLine{bLines, yLines, tLines} {
+			if len(lines) == 0 {
+				continue
+			}
+			if isBefore && bytes.Compare(key, lines[0].key) >= 0 {
+				return false
+			}
+			if !isBefore && bytes.Compare(lines[len(lines)-1].key, key) >= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	if !inList(before, true) && !inList(after, false) {
+		glog.V(1).Infof("ResolveSortedListConflict: conflict is not within a list")
+		return nil, false
+	}
+
+	// Apply the set operations.
+	bMap, yMap, tMap := sortedListMap(bLines), sortedListMap(yLines), sortedListMap(tLines)
+	var result []sortedListLine
+	for key, yLine := range yMap {
+		bLine, inBase := bMap[key]
+		tLine, inTheirs := tMap[key]
+		if !inBase {
+			// Inserted by yours (and maybe by theirs).
+			if inTheirs && !bytes.Equal(yLine, tLine) {
+				return nil, false
+			}
+			result = append(result, sortedListLine{[]byte(key), yLine})
+		} else if inTheirs {
+			// Retained by both; either may have modified the line while keeping
+			// the key the same, but not differently.
+			line := yLine
+			if bytes.Equal(yLine, bLine) {
+				line = tLine
+			} else if !bytes.Equal(tLine, bLine) && !bytes.Equal(tLine, yLine) {
+				return nil, false
+			}
+			result = append(result, sortedListLine{[]byte(key), line})
+		} else if !bytes.Equal(yLine, bLine) {
+			// Deleted by theirs, but modified by yours.
+			return nil, false
+		}
+	}
+	for key, tLine := range tMap {
+		if _, inYours := yMap[key]; inYours {
+			continue
+		}
+		if bLine, inBase := bMap[key]; inBase {
+			if !bytes.Equal(tLine, bLine) {
+				// Deleted by yours, but modified by theirs.
+				return nil, false
+			}
+			continue
+		}
+		// Inserted by theirs only.
+		result = append(result, sortedListLine{[]byte(key), tLine})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].key, result[j].key) < 0
+	})
+	for _, entry := range result {
+		resolved = append(resolved, entry.line)
+	}
+	glog.Infof("ResolveSortedListConflict resolved base lines [%d, %d) as a list of %d lines",
+		bStart, bBeyond, len(resolved))
+	return resolved, true
+}
+
+// Returns the lines [start, beyond) of f, with their keys, if they are
+// strictly sorted by key, and all end with a newline.
+func getSortedListLines(f *File, start, beyond int, keyFn SortKeyFunc) (
+	lines []sortedListLine, ok bool) {
+	for n := start; n < beyond; n++ {
+		line := f.GetLineBytes(n)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			return nil, false
+		}
+		key := keyFn(line)
+		if len(key) == 0 {
+			return nil, false
+		}
+		if len(lines) > 0 && bytes.Compare(lines[len(lines)-1].key, key) >= 0 {
+			return nil, false
+		}
+		lines = append(lines, sortedListLine{key, line})
+	}
+	return lines, true
+}
+
+// Returns the leading whitespace shared by all of the lines, or nil if they
+// don't all have the same leading whitespace (or there are no lines).
+func findListIndent(lineLists ...[]sortedListLine) (indent []byte) {
+	for _, lines := range lineLists {
+		for _, entry := range lines {
+			lineIndent := leadingWhitespace(entry.line)
+			if indent == nil {
+				indent = lineIndent
+			} else if !bytes.Equal(indent, lineIndent) {
+				return nil
+			}
+		}
+	}
+	return
+}
+
+func leadingWhitespace(line []byte) []byte {
+	return line[:len(line)-len(removeIndent(line))]
+}
+
+func sortedListMap(lines []sortedListLine) map[string][]byte {
+	m := make(map[string][]byte)
+	for _, entry := range lines {
+		m[string(entry.key)] = entry.line
+	}
+	return m
+}
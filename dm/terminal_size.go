@@ -0,0 +1,18 @@
+package dm
+
+import (
+	"os"
+	"strconv"
+)
+
+// Returns the number of columns of the terminal to which f is connected, else
+// the value of $COLUMNS, else defaultColumns.
+func TerminalColumns(f *os.File, defaultColumns int) int {
+	if columns := terminalWidth(f); columns > 0 {
+		return columns
+	}
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return defaultColumns
+}
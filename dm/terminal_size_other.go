@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package dm
+
+import (
+	"os"
+)
+
+// Determining the width of the terminal isn't supported on this platform.
+func terminalWidth(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin
+
+package dm
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Returns the width of the terminal to which f is connected, or 0 if it isn't
+// a terminal.
+func terminalWidth(f *os.File) int {
+	var size struct {
+		rows, cols, xPixels, yPixels uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0
+	}
+	return int(size.cols)
+}
@@ -0,0 +1,32 @@
+package dm
+
+import (
+	"testing"
+)
+
+// Helpers shared by the tests of the package.
+
+func readTestFile(t *testing.T, name string) *File {
+	f, err := ReadFile("../data/" + name)
+	if err != nil {
+		t.Fatalf("Unable to read test file %s: %s", name, err)
+	}
+	return f
+}
+
+func performTestDiff2(t *testing.T, aName, bName string) (aFile, bFile *File, pairs BlockPairs) {
+	aFile, bFile = readTestFile(t, aName), readTestFile(t, bName)
+	return aFile, bFile, PerformDiff2(aFile, bFile, DefaultDifferencerConfig())
+}
+
+func performTestDiff3(t *testing.T, yoursName, baseName, theirsName string) (
+	yours, base, theirs *File, triples Diff3Triples, conflictsExist bool) {
+	yours = readTestFile(t, yoursName)
+	base = readTestFile(t, baseName)
+	theirs = readTestFile(t, theirsName)
+	cfg := DefaultDifferencerConfig()
+	b2yPairs := PerformDiff2(base, yours, cfg)
+	b2tPairs := PerformDiff2(base, theirs, cfg)
+	triples, conflictsExist = PerformDiff3(yours, base, theirs, b2yPairs, b2tPairs, cfg)
+	return
+}
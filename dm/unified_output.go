@@ -0,0 +1,106 @@
+package dm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Formats the differences between two files as a unified diff, as produced
+// by "diff -u" and accepted by patch(1) and "git apply". The BlockPairs are
+// those produced by PerformDiff2; as a unified diff can't represent moves,
+// moved lines are output as deleted from their original location and
+// inserted at their new location (see BaseAnchoredChanges).
+
+// A group of changes that are close enough together (i.e. separated by at
+// most 2*contextLines unchanged lines) to be output as a single hunk, with
+// the ranges of lines of A and B (including context) that it covers.
+type diffHunk struct {
+	changes         BlockPairs
+	aStart, aBeyond int
+	bStart, bBeyond int
+}
+
+// Groups the changes (as returned by BaseAnchoredChanges) into hunks, each
+// with up to contextLines of unchanged lines before and after each change.
+func groupChangesIntoHunks(aFile, bFile *File, changes BlockPairs, contextLines int) (
+	hunks []*diffHunk) {
+	contextLines = MaxInt(0, contextLines)
+	var hunk *diffHunk
+	for _, change := range changes {
+		if hunk != nil && change.AIndex-hunk.changes[len(hunk.changes)-1].ABeyond() <= 2*contextLines {
+			hunk.changes = append(hunk.changes, change)
+			continue
+		}
+		hunk = &diffHunk{changes: BlockPairs{change}}
+		hunks = append(hunks, hunk)
+	}
+	for _, hunk := range hunks {
+		first, last := hunk.changes[0], hunk.changes[len(hunk.changes)-1]
+		before := MinInt(contextLines, MinInt(first.AIndex, first.BIndex))
+		after := MinInt(contextLines, MinInt(
+			aFile.LineCount()-last.ABeyond(), bFile.LineCount()-last.BBeyond()))
+		hunk.aStart, hunk.bStart = first.AIndex-before, first.BIndex-before
+		hunk.aBeyond, hunk.bBeyond = last.ABeyond()+after, last.BBeyond()+after
+	}
+	return
+}
+
+// Formats a range of lines in the form used in unified diff hunk headers:
+// "3" for just line 3, "3,4" for the 4 lines starting at line 3, and "2,0"
+// for an empty range after line 2.
+func formatUnifiedRange(start, beyond int) string {
+	switch beyond - start {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, beyond-start)
+}
+
+// Writes the unified diff, with contextLines of unchanged lines around each
+// change. Nothing is written if the files are the same.
+func FormatUnifiedDiff(aFile, bFile *File, pairs BlockPairs, contextLines int,
+	w io.Writer) error {
+	_, changes := BaseAnchoredChanges(aFile, bFile, pairs)
+	hunks := groupChangesIntoHunks(aFile, bFile, changes, contextLines)
+	if len(hunks) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n",
+		aFile.DisplayName(), bFile.DisplayName()); err != nil {
+		return err
+	}
+	for _, hunk := range hunks {
+		if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			formatUnifiedRange(hunk.aStart, hunk.aBeyond),
+			formatUnifiedRange(hunk.bStart, hunk.bBeyond)); err != nil {
+			return err
+		}
+		aIndex := hunk.aStart
+		for _, change := range hunk.changes {
+			// Unchanged lines before the change.
+			if err := writeIndentedLines(w, aFile, aIndex, change.AIndex, " "); err != nil {
+				return err
+			}
+			if err := writeIndentedLines(w, aFile, change.AIndex, change.ABeyond(), "-"); err != nil {
+				return err
+			}
+			if err := writeIndentedLines(w, bFile, change.BIndex, change.BBeyond(), "+"); err != nil {
+				return err
+			}
+			aIndex = change.ABeyond()
+		}
+		if err := writeIndentedLines(w, aFile, aIndex, hunk.aBeyond, " "); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func FormatUnifiedDiffToString(aFile, bFile *File, pairs BlockPairs, contextLines int) string {
+	var buf bytes.Buffer
+	FormatUnifiedDiff(aFile, bFile, pairs, contextLines, &buf)
+	return buf.String()
+}
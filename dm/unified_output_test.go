@@ -0,0 +1,31 @@
+package dm
+
+import (
+	"testing"
+)
+
+func TestFormatUnifiedDiff(t *testing.T) {
+	lao, tzu := readTestFile(t, "lao"), readTestFile(t, "tzu")
+	lao.Label, tzu.Label = "a/lao", "b/tzu"
+	cfg := DefaultDifferencerConfig()
+	pairs := PerformDiff2(lao, tzu, cfg)
+	expected := "--- a/lao\n" +
+		"+++ b/tzu\n" +
+		"@@ -1,2 +0,0 @@\n" +
+		"-     The Way that can be told of is not the eternal Way;\n" +
+		"-     The name that can be named is not the eternal name.\n" +
+		"@@ -4 +2,2 @@\n" +
+		"-     The Named is the mother of all things.\n" +
+		"+     The named is the mother of all things.\n" +
+		"+     \n" +
+		"@@ -11,0 +11,3 @@\n" +
+		"+     They both may be called deep and profound.\n" +
+		"+     Deeper and more profound,\n" +
+		"+     The door of all subtleties!\n"
+	if s := FormatUnifiedDiffToString(lao, tzu, pairs, 0); s != expected {
+		t.Errorf("Unexpected unified diff:\n%s\nExpected:\n%s", s, expected)
+	}
+	if s := FormatUnifiedDiffToString(lao, lao, PerformDiff2(lao, lao, cfg), 3); s != "" {
+		t.Errorf("Expected no output for identical files, not:\n%s", s)
+	}
+}
@@ -35,6 +35,13 @@ func MaxInt(i, j int) int {
 	}
 }
 
+func AbsInt(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
 /*
 func MinFloat32(u, v float32) float32 {
 	if u < v {